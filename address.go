@@ -0,0 +1,73 @@
+package rmb
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultPort is used for twin addresses without a port
+	defaultPort = 8051
+)
+
+// parseTwinAddress builds the base url of a twin from its address. The address
+// can be an IP or a host name (the default `http://<address>:8051` is used),
+// a host:port pair (IPv6 addresses must be bracketed, e.g. `[200::1]:8051`),
+// or a full url like `https://example.com:8443/rmb`. Urls with other schemes
+// (e.g. `unix:///run/rmb.sock`) are kept as is for their transport.
+func parseTwinAddress(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	if address == "" {
+		return "", fmt.Errorf("empty twin address")
+	}
+
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid twin address '%s'", address)
+		}
+		if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return "", fmt.Errorf("twin address '%s' must not have credentials, query or fragment", address)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			// the other schemes are checked by their transport
+			return strings.TrimSuffix(u.String(), "/"), nil
+		}
+		if u.Host == "" || u.Hostname() == "" {
+			return "", fmt.Errorf("missing host in twin address '%s'", address)
+		}
+		if port := u.Port(); port != "" {
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return "", fmt.Errorf("invalid port in twin address '%s'", address)
+			}
+		}
+		return strings.TrimSuffix(u.String(), "/"), nil
+	}
+
+	// a raw IP, IPv6 addresses contain colons so they are checked first
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")); ip != nil {
+		return fmt.Sprintf("http://%s", net.JoinHostPort(ip.String(), strconv.Itoa(defaultPort))), nil
+	}
+
+	host, port := address, strconv.Itoa(defaultPort)
+	if strings.Contains(address, ":") {
+		var err error
+		host, port, err = net.SplitHostPort(address)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid twin address '%s'", address)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", fmt.Errorf("invalid port in twin address '%s'", address)
+		}
+	}
+	if host == "" || strings.ContainsAny(host, "/?#@[] ") {
+		return "", fmt.Errorf("invalid host in twin address '%s'", address)
+	}
+
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, port)), nil
+}
@@ -8,12 +8,17 @@ import (
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 )
 
 var (
 	ErrNotAvailable = fmt.Errorf("not available")
+	// ErrReplayedMessage is returned if a message was already received before
+	ErrReplayedMessage = fmt.Errorf("message was already received (replayed)")
+	// ErrRelayFull is returned if a relayed twin has too many messages waiting
+	ErrRelayFull = fmt.Errorf("too many messages are waiting for the twin")
 
 	tagsMap = map[string]Tag{
 		"msgbus.system.local":  Local,
@@ -53,8 +58,32 @@ type Backend interface {
 	PopRetryMessages(ctx context.Context, olderThan time.Duration) ([]Message, error)
 
 	PopExpiredBacklogMessages(ctx context.Context) ([]Message, error)
+
+	// MarkSeen records the message key for ttl, it returns ErrReplayedMessage
+	// if the key is already recorded
+	MarkSeen(ctx context.Context, key string, ttl time.Duration) error
+
+	// RegisterRelayed records that twin gets its messages from this relay for ttl
+	RegisterRelayed(ctx context.Context, twin int, ttl time.Duration) error
+	IsRelayed(ctx context.Context, twin int) (bool, error)
+	// PushRelayed holds a message for a relayed twin until it expires, it
+	// returns ErrRelayFull if the twin has too many messages waiting
+	PushRelayed(ctx context.Context, twin int, envelope Envelope, expiration time.Time) error
+	// NextRelayed returns the batch of messages in flight to twin, or moves up
+	// to max messages held for twin to a new batch in flight. The batch stays
+	// in flight until it's acknowledged with AckRelayed, the expired messages
+	// are dropped. batch is empty if no messages are held for twin.
+	NextRelayed(ctx context.Context, twin int, max int) (batch string, envelopes []Envelope, err error)
+	// AckRelayed drops the batch in flight to twin once it's delivered, it does
+	// nothing if batch is not the one in flight
+	AckRelayed(ctx context.Context, twin int, batch string) error
 }
 
+const (
+	// relayMaxMessages is the maximum number of messages held for a relayed twin
+	relayMaxMessages = 1000
+)
+
 type RedisBackend struct {
 	// looks like it's implemented as a pool
 	client *redis.Client
@@ -181,6 +210,10 @@ func (r *RedisBackend) PopMessageFromBacklog(ctx context.Context, id string) (Me
 }
 
 func (r *RedisBackend) QueueCommand(ctx context.Context, msg Message) error {
+	if err := ValidateCommand(msg.Command); err != nil {
+		return err
+	}
+
 	bytes, err := json.Marshal(msg)
 	if err != nil {
 		return errors.Wrap(err, "failed to encode into json")
@@ -191,6 +224,10 @@ func (r *RedisBackend) QueueCommand(ctx context.Context, msg Message) error {
 }
 
 func (r *RedisBackend) PushProcessedMessage(ctx context.Context, msg Message) error {
+	if err := ValidateReturnQueue(msg.Retqueue); err != nil {
+		return err
+	}
+
 	bytes, err := json.Marshal(msg)
 	if err != nil {
 		return errors.Wrap(err, "failed to encode into json")
@@ -274,3 +311,141 @@ func (r *RedisBackend) PopExpiredBacklogMessages(ctx context.Context) ([]Message
 	}
 	return msgs, err
 }
+
+func (r *RedisBackend) MarkSeen(ctx context.Context, key string, ttl time.Duration) error {
+	ok, err := r.client.SetNX(ctx, fmt.Sprintf("msgbus.system.seen.%s", key), 1, ttl).Result()
+	if err != nil {
+		return errors.Wrap(err, "couldn't record message")
+	}
+	if !ok {
+		return ErrReplayedMessage
+	}
+	return nil
+}
+
+func (r *RedisBackend) RegisterRelayed(ctx context.Context, twin int, ttl time.Duration) error {
+	return r.client.Set(ctx, fmt.Sprintf("msgbus.relay.twin.%d", twin), 1, ttl).Err()
+}
+
+func (r *RedisBackend) IsRelayed(ctx context.Context, twin int) (bool, error) {
+	count, err := r.client.Exists(ctx, fmt.Sprintf("msgbus.relay.twin.%d", twin)).Result()
+	if err != nil {
+		return false, err
+	}
+	return count == 1, nil
+}
+
+// relayedEntry is a held message with its expiration
+type relayedEntry struct {
+	Envelope   Envelope `json:"envelope"`
+	Expiration int64    `json:"expiration"`
+}
+
+// pushRelayedScript appends an entry to the queue of a relayed twin unless it's
+// full, and keeps the queue until the entry expires
+var pushRelayedScript = redis.NewScript(`
+if redis.call('LLEN', KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('RPUSH', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[3]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// nextRelayedScript returns the batch in flight with its entries, or moves the
+// first entries of the queue to a new batch in flight which is kept as long as
+// the queue
+var nextRelayedScript = redis.NewScript(`
+local batch = redis.call('GET', KEYS[3])
+if batch then
+	return {batch, redis.call('LRANGE', KEYS[2], 0, -1)}
+end
+local lines = redis.call('LRANGE', KEYS[1], 0, tonumber(ARGV[1]) - 1)
+if #lines == 0 then
+	return {'', {}}
+end
+local ttl = redis.call('PTTL', KEYS[1])
+redis.call('LTRIM', KEYS[1], #lines, -1)
+redis.call('DEL', KEYS[2])
+redis.call('RPUSH', KEYS[2], unpack(lines))
+redis.call('SET', KEYS[3], ARGV[2])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+	redis.call('PEXPIRE', KEYS[3], ttl)
+end
+return {ARGV[2], lines}
+`)
+
+// ackRelayedScript drops the batch in flight if it's the acknowledged one
+var ackRelayedScript = redis.NewScript(`
+if redis.call('GET', KEYS[2]) == ARGV[1] then
+	redis.call('DEL', KEYS[1], KEYS[2])
+	return 1
+end
+return 0
+`)
+
+func relayedKeys(twin int) (queue, inflight, batch string) {
+	return fmt.Sprintf("msgbus.relay.queue.%d", twin),
+		fmt.Sprintf("msgbus.relay.inflight.%d", twin),
+		fmt.Sprintf("msgbus.relay.batch.%d", twin)
+}
+
+func (r *RedisBackend) PushRelayed(ctx context.Context, twin int, envelope Envelope, expiration time.Time) error {
+	queue, _, _ := relayedKeys(twin)
+	bytes, err := json.Marshal(relayedEntry{Envelope: envelope, Expiration: expiration.Unix()})
+	if err != nil {
+		return errors.Wrap(err, "failed to encode into json")
+	}
+	// the queue is kept until its last message expires
+	ttl := time.Until(expiration).Milliseconds()
+	if ttl < 1 {
+		ttl = 1
+	}
+	pushed, err := pushRelayedScript.Run(ctx, r.client, []string{queue}, bytes, relayMaxMessages, ttl).Int()
+	if err != nil {
+		return err
+	}
+	if pushed == 0 {
+		return ErrRelayFull
+	}
+	return nil
+}
+
+func (r *RedisBackend) NextRelayed(ctx context.Context, twin int, max int) (string, []Envelope, error) {
+	queue, inflight, batchKey := relayedKeys(twin)
+	value, err := nextRelayedScript.Run(ctx, r.client, []string{queue, inflight, batchKey}, max, uuid.New().String()).Result()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "couldn't read relayed messages")
+	}
+	result, ok := value.([]interface{})
+	if !ok || len(result) != 2 {
+		return "", nil, fmt.Errorf("unexpected relayed messages result")
+	}
+	batch, _ := result[0].(string)
+	lines, _ := result[1].([]interface{})
+
+	envelopes := []Envelope{}
+	now := time.Now().Unix()
+	for _, line := range lines {
+		var entry relayedEntry
+		data, _ := line.(string)
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			log.Error().Err(errors.Wrap(err, "couldn't parse json")).Msg("handling relayed messages")
+			continue
+		}
+		if entry.Expiration < now {
+			log.Debug().Str("id", entry.Envelope.ID).Int("twin", twin).Msg("relayed message expired")
+			continue
+		}
+		envelopes = append(envelopes, entry.Envelope)
+	}
+	return batch, envelopes, nil
+}
+
+func (r *RedisBackend) AckRelayed(ctx context.Context, twin int, batch string) error {
+	_, inflight, batchKey := relayedKeys(twin)
+	return ackRelayedScript.Run(ctx, r.client, []string{inflight, batchKey}, batch).Err()
+}
@@ -35,6 +35,20 @@ func (m *MockBackend) EXPECT() *MockBackendMockRecorder {
 	return m.recorder
 }
 
+// AckRelayed mocks base method.
+func (m *MockBackend) AckRelayed(ctx context.Context, twin int, batch string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AckRelayed", ctx, twin, batch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AckRelayed indicates an expected call of AckRelayed.
+func (mr *MockBackendMockRecorder) AckRelayed(ctx, twin, batch interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AckRelayed", reflect.TypeOf((*MockBackend)(nil).AckRelayed), ctx, twin, batch)
+}
+
 // GetMessageReply mocks base method.
 func (m *MockBackend) GetMessageReply(ctx context.Context, msg MessageIdentifier) ([]Message, error) {
 	m.ctrl.T.Helper()
@@ -65,6 +79,35 @@ func (mr *MockBackendMockRecorder) IncrementID(ctx, id interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IncrementID", reflect.TypeOf((*MockBackend)(nil).IncrementID), ctx, id)
 }
 
+// IsRelayed mocks base method.
+func (m *MockBackend) IsRelayed(ctx context.Context, twin int) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IsRelayed", ctx, twin)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// IsRelayed indicates an expected call of IsRelayed.
+func (mr *MockBackendMockRecorder) IsRelayed(ctx, twin interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsRelayed", reflect.TypeOf((*MockBackend)(nil).IsRelayed), ctx, twin)
+}
+
+// MarkSeen mocks base method.
+func (m *MockBackend) MarkSeen(ctx context.Context, key string, ttl time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkSeen", ctx, key, ttl)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MarkSeen indicates an expected call of MarkSeen.
+func (mr *MockBackendMockRecorder) MarkSeen(ctx, key, ttl interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkSeen", reflect.TypeOf((*MockBackend)(nil).MarkSeen), ctx, key, ttl)
+}
+
 // Next mocks base method.
 func (m *MockBackend) Next(ctx context.Context, timeout time.Duration) (Envelope, error) {
 	m.ctrl.T.Helper()
@@ -80,6 +123,22 @@ func (mr *MockBackendMockRecorder) Next(ctx, timeout interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Next", reflect.TypeOf((*MockBackend)(nil).Next), ctx, timeout)
 }
 
+// NextRelayed mocks base method.
+func (m *MockBackend) NextRelayed(ctx context.Context, twin, max int) (string, []Envelope, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NextRelayed", ctx, twin, max)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].([]Envelope)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// NextRelayed indicates an expected call of NextRelayed.
+func (mr *MockBackendMockRecorder) NextRelayed(ctx, twin, max interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NextRelayed", reflect.TypeOf((*MockBackend)(nil).NextRelayed), ctx, twin, max)
+}
+
 // PopExpiredBacklogMessages mocks base method.
 func (m *MockBackend) PopExpiredBacklogMessages(ctx context.Context) ([]Message, error) {
 	m.ctrl.T.Helper()
@@ -139,6 +198,20 @@ func (mr *MockBackendMockRecorder) PushProcessedMessage(ctx, msg interface{}) *g
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PushProcessedMessage", reflect.TypeOf((*MockBackend)(nil).PushProcessedMessage), ctx, msg)
 }
 
+// PushRelayed mocks base method.
+func (m *MockBackend) PushRelayed(ctx context.Context, twin int, envelope Envelope, expiration time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PushRelayed", ctx, twin, envelope, expiration)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PushRelayed indicates an expected call of PushRelayed.
+func (mr *MockBackendMockRecorder) PushRelayed(ctx, twin, envelope, expiration interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PushRelayed", reflect.TypeOf((*MockBackend)(nil).PushRelayed), ctx, twin, envelope, expiration)
+}
+
 // PushToBacklog mocks base method.
 func (m *MockBackend) PushToBacklog(ctx context.Context, msg Message, id string) error {
 	m.ctrl.T.Helper()
@@ -208,3 +281,17 @@ func (mr *MockBackendMockRecorder) QueueRetry(ctx, msg interface{}) *gomock.Call
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QueueRetry", reflect.TypeOf((*MockBackend)(nil).QueueRetry), ctx, msg)
 }
+
+// RegisterRelayed mocks base method.
+func (m *MockBackend) RegisterRelayed(ctx context.Context, twin int, ttl time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RegisterRelayed", ctx, twin, ttl)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RegisterRelayed indicates an expected call of RegisterRelayed.
+func (mr *MockBackendMockRecorder) RegisterRelayed(ctx, twin, ttl interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RegisterRelayed", reflect.TypeOf((*MockBackend)(nil).RegisterRelayed), ctx, twin, ttl)
+}
@@ -0,0 +1,245 @@
+package rmb
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+
+	// closed circuits not used for that long are forgotten
+	breakerIdle = 10 * time.Minute
+)
+
+var (
+	// ErrCircuitOpen is returned for messages to a twin that failed too many times
+	// in a row, until the circuit is tried again
+	ErrCircuitOpen = fmt.Errorf("twin is unreachable (circuit open)")
+)
+
+type breakerState int
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerConfig configures the circuit breaker of each destination twin. The
+// circuit opens after FailureThreshold consecutive failures to reach the twin,
+// then messages to the twin fail right away for OpenTimeout. After that one
+// message is sent to try the twin (half-open), the circuit closes if it's
+// delivered or opens again.
+type BreakerConfig struct {
+	FailureThreshold int
+	OpenTimeout      time.Duration
+}
+
+// DefaultBreakerConfig returns the default circuit breaker configuration
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureThreshold: 5,
+		OpenTimeout:      30 * time.Second,
+	}
+}
+
+// Valid validates the circuit breaker configuration
+func (c *BreakerConfig) Valid() error {
+	if c.FailureThreshold <= 0 {
+		return fmt.Errorf("breaker failure threshold must be positive")
+	}
+	if c.OpenTimeout <= 0 {
+		return fmt.Errorf("breaker open timeout must be positive")
+	}
+	return nil
+}
+
+type circuit struct {
+	state       breakerState
+	failures    int
+	opened      time.Time
+	probing     bool
+	lastError   string
+	lastFailure time.Time
+	lastSuccess time.Time
+	used        time.Time
+}
+
+// TwinHealth is the circuit state of a destination twin
+type TwinHealth struct {
+	Twin        int        `json:"twin"`
+	State       string     `json:"state"`
+	Failures    int        `json:"failures"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	RetryAt     *time.Time `json:"retry_at,omitempty"`
+}
+
+// breakers tracks the circuit of each destination twin, a nil breakers
+// allows everything
+type breakers struct {
+	cfg      BreakerConfig
+	m        sync.Mutex
+	circuits map[int]*circuit
+	cleaned  time.Time
+}
+
+func newBreakers(cfg BreakerConfig) *breakers {
+	return &breakers{
+		cfg:      cfg,
+		circuits: make(map[int]*circuit),
+		cleaned:  time.Now(),
+	}
+}
+
+// allow checks if a message can be sent to twin, it returns ErrCircuitOpen if
+// the twin is considered down
+func (b *breakers) allow(twin int) error {
+	if b == nil {
+		return nil
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	now := time.Now()
+	b.cleanup(now)
+
+	c, ok := b.circuits[twin]
+	if !ok {
+		c = &circuit{}
+		b.circuits[twin] = c
+	}
+	c.used = now
+
+	switch c.state {
+	case breakerOpen:
+		if now.Sub(c.opened) < b.cfg.OpenTimeout {
+			return errors.Wrapf(ErrCircuitOpen, "twin %d, last error: %s", twin, c.lastError)
+		}
+		c.state = breakerHalfOpen
+		c.probing = true
+		return nil
+	case breakerHalfOpen:
+		// only one message tries the twin at a time
+		if c.probing {
+			return errors.Wrapf(ErrCircuitOpen, "twin %d, last error: %s", twin, c.lastError)
+		}
+		c.probing = true
+		return nil
+	}
+	return nil
+}
+
+// cancel gives back the try allowed to twin when the message couldn't be sent,
+// e.g. it failed to be prepared, the circuit is left as it was
+func (b *breakers) cancel(twin int) {
+	if b == nil {
+		return
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if c, ok := b.circuits[twin]; ok {
+		c.probing = false
+	}
+}
+
+// record records the result of sending a message to twin. Only the failures to
+// reach the twin count, errors returned by the twin itself mean it's up.
+func (b *breakers) record(twin int, err error) {
+	if b == nil {
+		return
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	c, ok := b.circuits[twin]
+	if !ok {
+		c = &circuit{}
+		b.circuits[twin] = c
+	}
+	now := time.Now()
+	c.used = now
+	c.probing = false
+
+	if err == nil || !errors.Is(err, ErrTwinUnreachable) {
+		c.state = breakerClosed
+		c.failures = 0
+		c.lastSuccess = now
+		return
+	}
+
+	c.failures++
+	c.lastError = err.Error()
+	c.lastFailure = now
+	if c.state == breakerHalfOpen || c.failures >= b.cfg.FailureThreshold {
+		c.state = breakerOpen
+		c.opened = now
+	}
+}
+
+// cleanup drops the closed circuits that were not used for a while
+func (b *breakers) cleanup(now time.Time) {
+	if now.Sub(b.cleaned) < time.Minute {
+		return
+	}
+	b.cleaned = now
+
+	for twin, c := range b.circuits {
+		if c.state == breakerClosed && now.Sub(c.used) > breakerIdle {
+			delete(b.circuits, twin)
+		}
+	}
+}
+
+// health returns the circuit state of all the known twins
+func (b *breakers) health() []TwinHealth {
+	if b == nil {
+		return []TwinHealth{}
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	table := make([]TwinHealth, 0, len(b.circuits))
+	for twin, c := range b.circuits {
+		entry := TwinHealth{
+			Twin:      twin,
+			State:     c.state.String(),
+			Failures:  c.failures,
+			LastError: c.lastError,
+		}
+		if !c.lastFailure.IsZero() {
+			lastFailure := c.lastFailure
+			entry.LastFailure = &lastFailure
+		}
+		if !c.lastSuccess.IsZero() {
+			lastSuccess := c.lastSuccess
+			entry.LastSuccess = &lastSuccess
+		}
+		if c.state == breakerOpen {
+			retryAt := c.opened.Add(b.cfg.OpenTimeout)
+			entry.RetryAt = &retryAt
+		}
+		table = append(table, entry)
+	}
+
+	sort.Slice(table, func(i, j int) bool {
+		return table[i].Twin < table[j].Twin
+	})
+	return table
+}
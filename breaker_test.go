@@ -0,0 +1,91 @@
+package rmb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreakers(t *testing.T) {
+	b := newBreakers(BreakerConfig{FailureThreshold: 2, OpenTimeout: 50 * time.Millisecond})
+	unreachable := unreachableError{fmt.Errorf("connection refused")}
+
+	// errors returned by the twin don't count
+	require.NoError(t, b.allow(1))
+	b.record(1, fmt.Errorf("failed to send remote: 400 Bad Request"))
+	require.NoError(t, b.allow(1))
+	b.record(1, unreachable)
+	require.NoError(t, b.allow(1))
+	b.record(1, unreachable)
+
+	err := b.allow(1)
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, "open", b.health()[0].State)
+	assert.NotNil(t, b.health()[0].RetryAt)
+
+	// only one message tries the twin once the timeout is over
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, b.allow(1))
+	assert.True(t, errors.Is(b.allow(1), ErrCircuitOpen))
+	b.record(1, unreachable)
+	assert.True(t, errors.Is(b.allow(1), ErrCircuitOpen))
+
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, b.allow(1))
+	b.record(1, nil)
+	require.NoError(t, b.allow(1))
+	assert.Equal(t, "closed", b.health()[0].State)
+	assert.Equal(t, 0, b.health()[0].Failures)
+
+	// other twins are not affected
+	require.NoError(t, b.allow(2))
+
+	// a try given back lets the next message try the twin
+	b.record(3, unreachable)
+	b.record(3, unreachable)
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, b.allow(3))
+	b.cancel(3)
+	require.NoError(t, b.allow(3))
+}
+
+func TestHandleFromLocalCircuitOpen(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	app, backend, resolver := setup(ctrl)
+	app.breakers = newBreakers(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+	app.breakers.record(2, unreachableError{fmt.Errorf("connection refused")})
+
+	msg := Message{
+		Version:  1,
+		Command:  "griddb.twins.get",
+		Retry:    2,
+		TwinDst:  []int{2},
+		Retqueue: "caller",
+		Epoch:    time.Now().Unix(),
+	}
+	err := app.handleFromLocalItem(context.TODO(), msg, 2)
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+
+	// the message is not prepared nor sent, it waits for the circuit without
+	// using a retry
+	client, _ := resolver.Resolve(2)
+	assert.Len(t, client.(*TwinClientMock).remote, 0)
+	assert.Empty(t, backend.ids)
+	require.Len(t, backend.retries, 1)
+	assert.Equal(t, 2, backend.retries[0].Retry)
+
+	// until it expires
+	msg.Epoch = time.Now().Add(-time.Hour).Unix()
+	msg.Expiration = 60
+	err = app.handleFromLocalItem(context.TODO(), msg, 2)
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.Len(t, backend.retries, 1)
+	require.Len(t, backend.commandReplies["caller"], 1)
+	assert.Contains(t, backend.commandReplies["caller"][0].Err, "circuit open")
+}
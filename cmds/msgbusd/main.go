@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"strings"
@@ -18,18 +19,77 @@ import (
 )
 
 type flags struct {
-	substrate string
-	debug     string
-	redis     string
-	mnemonics string
-	key_type  string
-	workers   int
+	substrate  string
+	debug      string
+	redis      string
+	mnemonics  string
+	key_type   string
+	workers    int
+	encrypt    bool
+	clockSkew  time.Duration
+	allowCmds  string
+	denyCmds   string
+	policy     string
+	rateLimits string
+	admin      string
+	resolver   string
+	twins      string
+	tls        bool
+	tlsPeer    bool
+	publicCA   bool
+	failures   int
+	openFor    time.Duration
+	unix       string
+	quic       string
+	proxy      string
+	noProxy    string
+	links      string
+	relayMode  bool
+	relay      string
+	relayPoll  time.Duration
+	gridRelay  string
 }
 
 func (f *flags) Valid() error {
 	if f.mnemonics == "" {
 		return fmt.Errorf("mnemonics id is required")
 	}
+	if f.failures <= 0 || f.openFor <= 0 {
+		return fmt.Errorf("circuit breaker failures and timeout must be positive")
+	}
+	proxy := rmb.ProxyConfig{URL: f.proxy, Bypass: splitList(f.noProxy)}
+	if err := proxy.Valid(); err != nil {
+		return err
+	}
+	if f.relayPoll < 0 {
+		return fmt.Errorf("relay poll interval can't be negative")
+	}
+	if f.tlsPeer && !f.tls {
+		return fmt.Errorf("--tls-require-peer requires --tls")
+	}
+	if f.encrypt && f.gridRelay != "" {
+		return fmt.Errorf("--encrypt can't be used with --grid-relay")
+	}
+	resolvers := splitList(f.resolver)
+	if len(resolvers) == 0 {
+		return fmt.Errorf("at least one resolver is required")
+	}
+	seen := make(map[string]bool)
+	for _, resolver := range resolvers {
+		switch resolver {
+		case "substrate":
+		case "static":
+			if f.twins == "" {
+				return fmt.Errorf("twins file is required by the static resolver")
+			}
+		default:
+			return fmt.Errorf("unknown resolver '%s'", resolver)
+		}
+		if seen[resolver] {
+			return fmt.Errorf("resolver '%s' is set more than once", resolver)
+		}
+		seen[resolver] = true
+	}
 	return nil
 }
 
@@ -40,6 +100,29 @@ func main() {
 	flag.StringVar(&f.mnemonics, "mnemonics", "", "mnemonics")
 	flag.StringVar(&f.key_type, "key-type", "sr25519", "key type")
 	flag.IntVar(&f.workers, "workers", 1000, "workers is number of active channels that communicate with the backend")
+	flag.BoolVar(&f.encrypt, "encrypt", false, "encrypt messages data sent to other twins")
+	flag.StringVar(&f.allowCmds, "allow-cmd", "", "comma separated command patterns remote twins are allowed to call (default all)")
+	flag.StringVar(&f.denyCmds, "deny-cmd", "", "comma separated command patterns remote twins are not allowed to call")
+	flag.StringVar(&f.policy, "policy", "", "access policy file deciding which twins can call which commands (reloaded on changes)")
+	flag.StringVar(&f.rateLimits, "rate-limits", "", "rate limits file for the messages received from remote twins")
+	flag.StringVar(&f.admin, "admin-listen", "", "listen address of the admin endpoints, e.g. 127.0.0.1:8052 (disabled by default)")
+	flag.StringVar(&f.resolver, "resolver", "substrate", "comma separated resolvers asked in order to resolve twins [substrate|static], e.g. static,substrate to override some twins")
+	flag.StringVar(&f.twins, "twins", "", "twins file used by the static resolver (reloaded on changes)")
+	flag.BoolVar(&f.tls, "tls", false, "serve the other twins over TLS with a certificate bound to the twin identity (the twin address must be https)")
+	flag.BoolVar(&f.tlsPeer, "tls-require-peer", false, "only accept messages from twins over mutual TLS (requires --tls)")
+	flag.BoolVar(&f.publicCA, "tls-public-ca", false, "accept https twins with a certificate from a public CA instead of one bound to the twin (e.g. behind a reverse proxy)")
+	flag.StringVar(&f.unix, "listen-unix", "", "also serve the other twins on this unix socket (for twins with a unix:// address)")
+	flag.StringVar(&f.quic, "listen-quic", "", "also serve the other twins over QUIC on this UDP address, e.g. :8051 (for twins with a quic:// address)")
+	flag.StringVar(&f.links, "link", "", "comma separated addresses of peers this twin keeps a WebSocket link open to, so they can reach it behind NAT")
+	flag.BoolVar(&f.relayMode, "relay-mode", false, "hold the messages of the twins registered on this server until they get them (see --relay)")
+	flag.StringVar(&f.relay, "relay", "", "address of the relay this twin gets its messages from, the twin address must be relay://<relay address>")
+	flag.DurationVar(&f.relayPoll, "relay-poll", 0, "interval to poll the relay for messages, 0 keeps a WebSocket link open to the relay instead")
+	flag.StringVar(&f.gridRelay, "grid-relay", "", "url of a relay of the newer rmb (wss://...) to exchange messages with the twins using it")
+	flag.StringVar(&f.proxy, "proxy", "", "proxy used to connect to the other twins, http://[user:pass@]host:port (HTTP CONNECT), socks5://[user:pass@]host:port or socks5h://[user:pass@]host:port")
+	flag.StringVar(&f.noProxy, "no-proxy", "", "comma separated destinations reached without the proxy: IPs, ranges (e.g. 200::/7), hosts and domains (.example.com)")
+	flag.IntVar(&f.failures, "breaker-failures", rmb.DefaultBreakerConfig().FailureThreshold, "consecutive failures to reach a twin before its messages fail right away")
+	flag.DurationVar(&f.openFor, "breaker-timeout", rmb.DefaultBreakerConfig().OpenTimeout, "time messages to an unreachable twin fail right away before trying it again")
+	flag.DurationVar(&f.clockSkew, "clock-skew", rmb.DefaultClockSkew, "accepted difference between received messages timestamp and local time")
 	flag.Parse()
 
 	if err := f.Valid(); err != nil {
@@ -64,13 +147,112 @@ func constructSigner(mnemonics string, key_type string) (substrate.Identity, err
 	}
 }
 
+// splitList splits a comma separated flag value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func app(f flags) error {
 	identity, err := constructSigner(f.mnemonics, f.key_type)
 	if err != nil {
 		return err
 	}
-	mgr := substrate.NewManager(f.substrate)
-	s, err := rmb.NewServer(mgr, f.redis, f.workers, identity)
+	commands, err := rmb.NewCommandFilter(splitList(f.allowCmds), splitList(f.denyCmds))
+	if err != nil {
+		return err
+	}
+	transport := rmb.DefaultTransportConfig()
+	transport.Proxy = rmb.ProxyConfig{URL: f.proxy, Bypass: splitList(f.noProxy)}
+	transport.PublicCA = f.publicCA
+	opts := []rmb.ServerOption{
+		rmb.WithTransport(transport),
+		rmb.WithEncryption(f.encrypt),
+		rmb.WithClockSkew(f.clockSkew),
+		rmb.WithCommandFilter(commands),
+		rmb.WithCircuitBreaker(rmb.BreakerConfig{FailureThreshold: f.failures, OpenTimeout: f.openFor}),
+	}
+	if f.policy != "" {
+		policy, err := rmb.NewPolicyStore(f.policy)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, rmb.WithPolicy(policy))
+	}
+	if f.rateLimits != "" {
+		limits, err := rmb.LoadRateLimits(f.rateLimits)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, rmb.WithRateLimits(limits))
+	}
+	if f.admin != "" {
+		opts = append(opts, rmb.WithAdminListen(f.admin))
+	}
+	if f.tls {
+		opts = append(opts, rmb.WithTLS(f.tlsPeer))
+	}
+	for _, address := range splitList(f.links) {
+		opts = append(opts, rmb.WithPeerLink(address))
+	}
+	if f.relayMode {
+		opts = append(opts, rmb.WithRelayMode())
+	}
+	if f.relay != "" {
+		opts = append(opts, rmb.WithRelay(f.relay, f.relayPoll))
+	}
+	if f.gridRelay != "" {
+		opts = append(opts, rmb.WithGridRelay(f.gridRelay))
+	}
+	if f.quic != "" {
+		opts = append(opts, rmb.WithQUIC(f.quic))
+	}
+	if f.unix != "" {
+		// a socket left by a previous run can't be listened on
+		if err := os.Remove(f.unix); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove old unix socket")
+		}
+		l, err := net.Listen("unix", f.unix)
+		if err != nil {
+			return errors.Wrap(err, "failed to listen on unix socket")
+		}
+		opts = append(opts, rmb.WithListener(l))
+	}
+
+	// the chain is only used if substrate is one of the resolvers
+	var mgr substrate.Manager
+	var resolvers []rmb.TwinResolver
+	for _, name := range splitList(f.resolver) {
+		switch name {
+		case "static":
+			resolver, err := rmb.NewStaticResolver(f.twins)
+			if err != nil {
+				return err
+			}
+			resolvers = append(resolvers, resolver)
+		case "substrate":
+			mgr = substrate.NewManager(f.substrate)
+			sub, err := mgr.Substrate()
+			if err != nil {
+				return errors.Wrap(err, "failed to connect to substrate")
+			}
+			defer sub.Close()
+			resolver, err := rmb.NewSubstrateResolver(sub)
+			if err != nil {
+				return err
+			}
+			resolvers = append(resolvers, rmb.NewCacheResolver(resolver, 5*time.Minute))
+			opts = append(opts, rmb.WithTwinEvents(rmb.NewSubstrateTwinEvents(mgr)))
+		}
+	}
+	opts = append(opts, rmb.WithResolver(rmb.NewChainedResolver(resolvers...)))
+
+	s, err := rmb.NewServer(mgr, f.redis, f.workers, identity, opts...)
 	if err != nil {
 		return errors.Wrap(err, "failed to create server")
 	}
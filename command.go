@@ -0,0 +1,123 @@
+package rmb
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrReservedCommand is returned for commands that would address the msgbus internal queues
+	ErrReservedCommand = fmt.Errorf("command is in a reserved namespace")
+	// ErrCommandNotAllowed is returned for commands refused by the node command filter
+	ErrCommandNotAllowed = fmt.Errorf("command is not allowed")
+	// ErrInvalidReturnQueue is returned for return queues that are not safe to write to
+	ErrInvalidReturnQueue = fmt.Errorf("invalid return queue")
+
+	// reservedNamespaces are the first segment of the msgbus internal keys,
+	// commands are pushed to `msgbus.<cmd>` so they must never start with one
+	// of them.
+	reservedNamespaces = []string{"system", "counter", "relay"}
+)
+
+const (
+	// replyQueue is the only msgbus internal queue a message can be returned to
+	replyQueue = "msgbus.system.reply"
+
+	maxReturnQueueLength = 256
+)
+
+// ValidateCommand makes sure the command can be safely used as a queue name,
+// and doesn't address one of the msgbus internal queues.
+func ValidateCommand(cmd string) error {
+	if cmd == "" {
+		return errors.New("missing command request")
+	}
+
+	for _, r := range cmd {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("invalid character in command '%s'", cmd)
+		}
+	}
+
+	namespace := strings.SplitN(cmd, ".", 2)[0]
+	for _, reserved := range reservedNamespaces {
+		if strings.EqualFold(namespace, reserved) {
+			return errors.Wrapf(ErrReservedCommand, "command '%s'", cmd)
+		}
+	}
+
+	return nil
+}
+
+// ValidateReturnQueue makes sure the return queue of a message is safe to push
+// the message to. The `msgbus.` namespace is reserved for the bus queues and the
+// commands queues, so only the reply queue is allowed from it.
+func ValidateReturnQueue(queue string) error {
+	if queue == "" {
+		return errors.Wrap(ErrInvalidReturnQueue, "return queue not defined")
+	}
+
+	if len(queue) > maxReturnQueueLength {
+		return errors.Wrapf(ErrInvalidReturnQueue, "return queue is longer than %d", maxReturnQueueLength)
+	}
+
+	for _, r := range queue {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errors.Wrapf(ErrInvalidReturnQueue, "invalid character in return queue '%s'", queue)
+		}
+	}
+
+	if strings.HasPrefix(strings.ToLower(queue), "msgbus.") && queue != replyQueue {
+		return errors.Wrapf(ErrInvalidReturnQueue, "return queue '%s' is in the reserved namespace", queue)
+	}
+
+	return nil
+}
+
+// CommandFilter decides which commands remote twins are allowed to call. Patterns
+// are matched against the full command name using path.Match syntax, for example
+// `zos.*` matches all the commands starting with `zos.`.
+//
+// A command matching any deny pattern is refused. If allow patterns are set, the
+// command must also match one of them.
+type CommandFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// NewCommandFilter creates a command filter and validates its patterns
+func NewCommandFilter(allow, deny []string) (CommandFilter, error) {
+	for _, pattern := range append(append([]string{}, allow...), deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return CommandFilter{}, errors.Wrapf(err, "invalid command pattern '%s'", pattern)
+		}
+	}
+
+	return CommandFilter{Allow: allow, Deny: deny}, nil
+}
+
+// Accept checks if cmd is accepted by the filter
+func (f *CommandFilter) Accept(cmd string) error {
+	if matchAny(f.Deny, cmd) {
+		return errors.Wrapf(ErrCommandNotAllowed, "command '%s'", cmd)
+	}
+
+	if len(f.Allow) != 0 && !matchAny(f.Allow, cmd) {
+		return errors.Wrapf(ErrCommandNotAllowed, "command '%s'", cmd)
+	}
+
+	return nil
+}
+
+func matchAny(patterns []string, cmd string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, cmd); ok {
+			return true
+		}
+	}
+	return false
+}
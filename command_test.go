@@ -0,0 +1,53 @@
+package rmb
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateCommand(t *testing.T) {
+	assert.NoError(t, ValidateCommand("zos.statistics.get"))
+	assert.NoError(t, ValidateCommand("systemd.status"))
+
+	for _, cmd := range []string{"system.local", "system.reply", "System.remote", "counter.2", "system"} {
+		assert.True(t, errors.Is(ValidateCommand(cmd), ErrReservedCommand), cmd)
+	}
+
+	// the messages held by the relay
+	for _, cmd := range []string{"relay.twin.7", "relay.queue.7", "relay.inflight.7", "relay.batch.7", "Relay.queue.7"} {
+		assert.True(t, errors.Is(ValidateCommand(cmd), ErrReservedCommand), cmd)
+	}
+	assert.NoError(t, ValidateCommand("relayd.status"))
+
+	assert.Error(t, ValidateCommand(""))
+	assert.Error(t, ValidateCommand("zos.statistics get"))
+}
+
+func TestCommandFilter(t *testing.T) {
+	_, err := NewCommandFilter([]string{"zos.["}, nil)
+	assert.Error(t, err)
+
+	filter, err := NewCommandFilter(nil, nil)
+	require.NoError(t, err)
+	assert.NoError(t, filter.Accept("anything.goes"))
+
+	filter, err = NewCommandFilter([]string{"zos.*", "griddb.twins.get"}, []string{"zos.admin.*"})
+	require.NoError(t, err)
+	assert.NoError(t, filter.Accept("zos.statistics.get"))
+	assert.NoError(t, filter.Accept("griddb.twins.get"))
+	assert.True(t, errors.Is(filter.Accept("zos.admin.reboot"), ErrCommandNotAllowed))
+	assert.True(t, errors.Is(filter.Accept("griddb.twins.delete"), ErrCommandNotAllowed))
+}
+
+func TestValidateReturnQueue(t *testing.T) {
+	assert.NoError(t, ValidateReturnQueue("5bf6bc8b-19f4-4b5a-90c7-e87d799fbc73"))
+	assert.NoError(t, ValidateReturnQueue("myapp.replies"))
+	assert.NoError(t, ValidateReturnQueue("msgbus.system.reply"))
+
+	for _, queue := range []string{"", "msgbus.system.local", "msgbus.system.remote", "msgbus.zos.statistics.get", "MSGBUS.system.local", "my queue"} {
+		assert.True(t, errors.Is(ValidateReturnQueue(queue), ErrInvalidReturnQueue), queue)
+	}
+}
@@ -0,0 +1,330 @@
+package rmb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+
+	sr25519 "github.com/ChainSafe/go-schnorrkel"
+	"github.com/gtank/ristretto255"
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/substrate-client"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Encrypted payloads are base64 encoded in the message data field with the following layout
+//
+//	version (1) | stanzas count (1) | stanzas | nonce (24) | sealed data
+//
+// The data is sealed with a random key, and the key is wrapped once for each possible
+// type of the destination key (stanza), since the chain only stores the raw public key
+// and not its type. The destination unwraps the stanza that matches its own key type.
+// Each stanza has the following layout
+//
+//	key type (1) | ephemeral public key (32) | wrapped key (48)
+const (
+	payloadVersion = 1
+
+	stanzaKeySize     = 32
+	stanzaWrappedSize = chacha20poly1305.KeySize + chacha20poly1305.Overhead
+	stanzaSize        = 1 + stanzaKeySize + stanzaWrappedSize
+)
+
+var (
+	// ErrEncryptionNotSupported is returned if the identity key can't be used to decrypt payloads
+	ErrEncryptionNotSupported = fmt.Errorf("encryption is not supported for this identity")
+
+	// prime of curve25519 field
+	curve25519P, _ = new(big.Int).SetString("57896044618658097711785492504343953926634992332820282019728792003956564819949", 10)
+)
+
+// Encrypt encrypts the message data for the owner of the given public key. Encrypted
+// messages are always signed with protocol version 2 so the encryption flag is covered
+// by the signature.
+func (m *Message) Encrypt(publicKey []byte) error {
+	if m.Encrypted {
+		return fmt.Errorf("message is already encrypted")
+	}
+	sealed, err := encryptPayload([]byte(m.Data), publicKey)
+	if err != nil {
+		return err
+	}
+	m.Version = ProtocolV2
+	m.Data = base64.StdEncoding.EncodeToString(sealed)
+	m.Encrypted = true
+	return nil
+}
+
+// Decrypt restores the message data using the identity private key
+func (m *Message) Decrypt(identity substrate.Identity) error {
+	if !m.Encrypted {
+		return nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(m.Data)
+	if err != nil {
+		return errors.Wrap(err, "couldn't decode encrypted payload")
+	}
+	data, err := decryptPayload(sealed, identity)
+	if err != nil {
+		return err
+	}
+	m.Data = string(data)
+	m.Encrypted = false
+	return nil
+}
+
+func encryptPayload(data []byte, publicKey []byte) ([]byte, error) {
+	if len(publicKey) != stanzaKeySize {
+		return nil, fmt.Errorf("invalid public key length %d", len(publicKey))
+	}
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	var stanzas [][]byte
+	if stanza, err := ed25519Stanza(key, publicKey); err == nil {
+		stanzas = append(stanzas, stanza)
+	}
+	if stanza, err := sr25519Stanza(key, publicKey); err == nil {
+		stanzas = append(stanzas, stanza)
+	}
+	if len(stanzas) == 0 {
+		return nil, fmt.Errorf("public key is not a valid ed25519 or sr25519 key")
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := []byte{payloadVersion, byte(len(stanzas))}
+	for _, stanza := range stanzas {
+		out = append(out, stanza...)
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, nil), nil
+}
+
+func decryptPayload(sealed []byte, identity substrate.Identity) ([]byte, error) {
+	if len(sealed) < 2 || sealed[0] != payloadVersion {
+		return nil, fmt.Errorf("unsupported encrypted payload format")
+	}
+	count := int(sealed[1])
+	sealed = sealed[2:]
+	if len(sealed) < count*stanzaSize+chacha20poly1305.NonceSizeX {
+		return nil, fmt.Errorf("encrypted payload is too short")
+	}
+
+	keyType, err := sigTypeToChar(identity.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	for i := 0; i < count; i++ {
+		stanza := sealed[i*stanzaSize : (i+1)*stanzaSize]
+		if stanza[0] != keyType {
+			continue
+		}
+		key, err = unwrapStanza(stanza, identity)
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if key == nil {
+		return nil, fmt.Errorf("payload is not encrypted for a %s key", identity.Type())
+	}
+	sealed = sealed[count*stanzaSize:]
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't decrypt payload")
+	}
+	return data, nil
+}
+
+// wrapKey encrypts the payload key with a key derived from the shared secret
+func wrapKey(keyType byte, key, shared, ephemeral, publicKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(stanzaKey(keyType, shared, ephemeral, publicKey))
+	if err != nil {
+		return nil, err
+	}
+	// the wrapping key is unique for each ephemeral key so a zero nonce is safe
+	nonce := make([]byte, aead.NonceSize())
+	stanza := append([]byte{keyType}, ephemeral...)
+	return aead.Seal(stanza, nonce, key, nil), nil
+}
+
+func unwrapKey(keyType byte, wrapped, shared, ephemeral, publicKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(stanzaKey(keyType, shared, ephemeral, publicKey))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	key, err := aead.Open(nil, nonce, wrapped, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't unwrap payload key")
+	}
+	return key, nil
+}
+
+func stanzaKey(keyType byte, shared, ephemeral, publicKey []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte("rmb.payload.v1"))
+	hash.Write([]byte{keyType})
+	hash.Write(shared)
+	hash.Write(ephemeral)
+	hash.Write(publicKey)
+	return hash.Sum(nil)
+}
+
+func unwrapStanza(stanza []byte, identity substrate.Identity) ([]byte, error) {
+	keyType, ephemeral, wrapped := stanza[0], stanza[1:1+stanzaKeySize], stanza[1+stanzaKeySize:]
+
+	kp, err := identity.KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	seed := kp.Seed()
+
+	var shared []byte
+	switch identity.Type() {
+	case SignatureTypeEd25519:
+		if len(seed) != 32 {
+			return nil, ErrEncryptionNotSupported
+		}
+		shared, err = curve25519.X25519(ed25519PrivateToCurve25519(seed), ephemeral)
+		if err != nil {
+			return nil, err
+		}
+	case SignatureTypeSr25519:
+		scalar, err := sr25519Scalar(seed, identity.PublicKey())
+		if err != nil {
+			return nil, err
+		}
+		point := ristretto255.NewElement()
+		if err := point.Decode(ephemeral); err != nil {
+			return nil, errors.Wrap(err, "invalid ephemeral key")
+		}
+		shared = point.ScalarMult(scalar, point).Encode(nil)
+	default:
+		return nil, ErrEncryptionNotSupported
+	}
+
+	return unwrapKey(keyType, wrapped, shared, ephemeral, identity.PublicKey())
+}
+
+func ed25519Stanza(key, publicKey []byte) ([]byte, error) {
+	point, err := ed25519PublicToCurve25519(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+	ephemeral, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(secret, point)
+	if err != nil {
+		return nil, err
+	}
+	return wrapKey('e', key, shared, ephemeral, publicKey)
+}
+
+func sr25519Stanza(key, publicKey []byte) ([]byte, error) {
+	point := ristretto255.NewElement()
+	if err := point.Decode(publicKey); err != nil {
+		return nil, err
+	}
+	uniform := make([]byte, 64)
+	if _, err := io.ReadFull(rand.Reader, uniform); err != nil {
+		return nil, err
+	}
+	secret := ristretto255.NewScalar().FromUniformBytes(uniform)
+	ephemeral := ristretto255.NewElement().ScalarBaseMult(secret).Encode(nil)
+	shared := point.ScalarMult(secret, point).Encode(nil)
+	return wrapKey('s', key, shared, ephemeral, publicKey)
+}
+
+// ed25519PublicToCurve25519 maps an edwards point to its montgomery u coordinate
+// u = (1 + y) / (1 - y)
+func ed25519PublicToCurve25519(publicKey []byte) ([]byte, error) {
+	le := make([]byte, len(publicKey))
+	copy(le, publicKey)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+	num := new(big.Int).Add(one, y)
+	u := num.Mul(num, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+
+	out := make([]byte, curve25519.PointSize)
+	u.FillBytes(out)
+	return reverse(out), nil
+}
+
+func ed25519PrivateToCurve25519(seed []byte) []byte {
+	h := sha512.Sum512(seed)
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return h[:curve25519.ScalarSize]
+}
+
+func sr25519Scalar(seed []byte, publicKey []byte) (*ristretto255.Scalar, error) {
+	if len(seed) != sr25519.MiniSecretKeySize {
+		return nil, ErrEncryptionNotSupported
+	}
+	var raw [sr25519.MiniSecretKeySize]byte
+	copy(raw[:], seed)
+	mini, err := sr25519.NewMiniSecretKeyFromRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	secret := mini.ExpandEd25519()
+	// derived keys don't expose their secret as a seed
+	pub, err := secret.Public()
+	if err != nil {
+		return nil, err
+	}
+	if encoded := pub.Encode(); string(encoded[:]) != string(publicKey) {
+		return nil, ErrEncryptionNotSupported
+	}
+	return sr25519.ScalarFromBytes(secret.Encode())
+}
+
+func reverse(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
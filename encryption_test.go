@@ -0,0 +1,53 @@
+package rmb
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/substrate-client"
+)
+
+const testMnemonics = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+func TestMessageEncryption(t *testing.T) {
+	ed, err := substrate.NewIdentityFromEd25519Phrase(testMnemonics)
+	require.NoError(t, err)
+	sr, err := substrate.NewIdentityFromSr25519Phrase(testMnemonics)
+	require.NoError(t, err)
+
+	for _, identity := range []substrate.Identity{ed, sr} {
+		t.Run(identity.Type(), func(t *testing.T) {
+			data := base64.StdEncoding.EncodeToString([]byte("secret payload"))
+			msg := Message{
+				Version:  ProtocolV1,
+				Command:  "griddb.twins.get",
+				Data:     data,
+				TwinDst:  []int{2},
+				Retqueue: "msgbus.system.reply",
+			}
+			require.NoError(t, msg.Encrypt(identity.PublicKey()))
+			assert.True(t, msg.Encrypted)
+			assert.Equal(t, ProtocolV2, msg.Version)
+			assert.NotEqual(t, data, msg.Data)
+
+			// signature covers the encryption flag
+			require.NoError(t, msg.Sign(identity))
+			stripped := msg
+			stripped.Encrypted = false
+			assert.Error(t, stripped.Verify(identity.PublicKey()))
+
+			other := ed
+			if identity == ed {
+				other = sr
+			}
+			wrong := msg
+			assert.Error(t, wrong.Decrypt(other))
+
+			require.NoError(t, msg.Decrypt(identity))
+			assert.False(t, msg.Encrypted)
+			assert.Equal(t, data, msg.Data)
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package rmb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// happyEyeballsDelay is the delay between the connection attempts to the
+	// endpoints of a twin (RFC 8305)
+	happyEyeballsDelay = 250 * time.Millisecond
+	// preferredDialTimeout limits the time to connect to the endpoint that
+	// answered last, before the other endpoints of the twin are tried
+	preferredDialTimeout = time.Second
+)
+
+// parseTwinAddresses parses a comma separated list of twin addresses to their
+// base urls, in the same order (see parseTwinAddress)
+func parseTwinAddresses(addresses ...string) ([]string, error) {
+	var endpoints []string
+	for _, list := range addresses {
+		for _, address := range strings.Split(list, ",") {
+			if strings.TrimSpace(address) == "" {
+				continue
+			}
+			base, err := parseTwinAddress(address)
+			if err != nil {
+				return nil, err
+			}
+			if !contains(endpoints, base) {
+				endpoints = append(endpoints, base)
+			}
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("twin has no address")
+	}
+	return endpoints, nil
+}
+
+func contains(items []string, item string) bool {
+	for _, current := range items {
+		if current == item {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointHost returns the host:port to dial for a base url
+func endpointHost(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// dialTimeout is the context key of a shorter time to connect to the peer than
+// the dialer timeout, the request can still reuse an idle connection
+type dialTimeout struct{}
+
+// racedConn is the context key of the connection that won the endpoints race,
+// the transport uses it for the request instead of dialing the endpoint again
+type racedConn struct{}
+
+// raced is the connection that won the endpoints race to host
+type raced struct {
+	host string
+	m    sync.Mutex
+	conn net.Conn
+}
+
+// withRaced sets the connection that won the race to endpoint on the context
+func withRaced(ctx context.Context, endpoint string, conn net.Conn) (context.Context, *raced) {
+	host, _ := endpointHost(endpoint)
+	race := &raced{host: host, conn: conn}
+	return context.WithValue(ctx, racedConn{}, race), race
+}
+
+// take returns the raced connection if it's to the host, it's only taken once
+func (r *raced) take(host string) net.Conn {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.host != host {
+		return nil
+	}
+	conn := r.conn
+	r.conn = nil
+	return conn
+}
+
+// release closes the raced connection if the transport didn't take it, e.g. it
+// had an idle connection to the endpoint already
+func (r *raced) release() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+}
+
+// raceEndpoints dials the endpoints in order with a staggered start (happy
+// eyeballs) and returns the first one that accepts a connection, with that
+// connection. The next endpoint is dialed after a short delay, or as soon as
+// an attempt fails. A single endpoint is not dialed.
+func raceEndpoints(ctx context.Context, dialer contextDialer, endpoints []string) (string, net.Conn, error) {
+	if len(endpoints) == 1 {
+		return endpoints[0], nil, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		endpoint string
+		conn     net.Conn
+		err      error
+	}
+	results := make(chan result, len(endpoints))
+	failed := make(chan struct{}, len(endpoints))
+	dial := func(endpoint string) {
+		var conn net.Conn
+		host, err := endpointHost(endpoint)
+		if err == nil {
+			conn, err = dialer.DialContext(ctx, "tcp", host)
+		}
+		if err != nil {
+			failed <- struct{}{}
+		}
+		results <- result{endpoint, conn, err}
+	}
+
+	go func() {
+		for i, endpoint := range endpoints {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					// report the endpoints that were not tried
+					for _, endpoint := range endpoints[i:] {
+						results <- result{endpoint, nil, ctx.Err()}
+					}
+					return
+				case <-failed:
+				case <-time.After(happyEyeballsDelay):
+				}
+			}
+			go dial(endpoint)
+		}
+	}()
+
+	var err error
+	for i := range endpoints {
+		res := <-results
+		if res.err == nil {
+			// the connections of the endpoints that lost are closed
+			go func(left int) {
+				for ; left > 0; left-- {
+					if res := <-results; res.conn != nil {
+						res.conn.Close()
+					}
+				}
+			}(len(endpoints) - i - 1)
+			return res.endpoint, res.conn, nil
+		}
+		err = errors.Wrapf(res.err, "couldn't connect to %s", res.endpoint)
+	}
+	return "", nil, err
+}
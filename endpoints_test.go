@@ -0,0 +1,164 @@
+package rmb
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTwinAddresses(t *testing.T) {
+	endpoints, err := parseTwinAddresses("10.0.0.1, 300:e9d7:b14f:8b32::1", "10.0.0.1", "https://rmb.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"http://10.0.0.1:8051",
+		"http://[300:e9d7:b14f:8b32::1]:8051",
+		"https://rmb.example.com",
+	}, endpoints)
+
+	_, err = parseTwinAddresses("", " , ")
+	assert.Error(t, err)
+}
+
+// deadEndpoint returns an endpoint nobody listens on
+func deadEndpoint(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+func countingServer(status int) (*httptest.Server, *int32) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.WriteHeader(status)
+		w.Write([]byte(`{"status": "error", "message": "refused"}`))
+	}))
+	return server, &count
+}
+
+func TestTwinClientFallback(t *testing.T) {
+	live, count := countingServer(http.StatusOK)
+	defer live.Close()
+
+	client := &twinClient{twin: 1001, endpoints: []string{deadEndpoint(t), live.URL}, transport: sharedDefaultTransport()}
+	require.NoError(t, client.SendRemote(Message{}))
+	assert.EqualValues(t, 1, atomic.LoadInt32(count))
+
+	// the endpoint that answered is tried first next time
+	candidates, preferred := client.candidates()
+	assert.True(t, preferred)
+	assert.Equal(t, live.URL, candidates[0])
+	require.NoError(t, client.SendReply(Message{}))
+	assert.EqualValues(t, 2, atomic.LoadInt32(count))
+
+	// all the endpoints are tried before giving up
+	dead := &twinClient{twin: 1002, endpoints: []string{deadEndpoint(t), deadEndpoint(t)}, transport: sharedDefaultTransport()}
+	assert.Error(t, dead.SendRemote(Message{}))
+}
+
+func TestTwinClientRaceConnection(t *testing.T) {
+	var conns int32
+	live := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	live.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	live.Start()
+	defer live.Close()
+
+	// the connection that won the race carries the message
+	client := &twinClient{twin: 1005, endpoints: []string{deadEndpoint(t), live.URL}, transport: testTransport(DefaultTransportConfig())}
+	require.NoError(t, client.SendRemote(Message{}))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&conns))
+
+	// and is kept in the pool
+	require.NoError(t, client.SendRemote(Message{}))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&conns))
+}
+
+// blackholeDialer never connects to host, like an address that drops the packets
+type blackholeDialer struct {
+	contextDialer
+	host string
+}
+
+func (d blackholeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if address == d.host {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return d.contextDialer.DialContext(ctx, network, address)
+}
+
+func TestTwinClientPreferredBlackholed(t *testing.T) {
+	live, count := countingServer(http.StatusOK)
+	defer live.Close()
+
+	const blackholed = "http://10.255.255.1:8051"
+	transport := testTransport(DefaultTransportConfig())
+	transport.dialer = blackholeDialer{transport.dialer, "10.255.255.1:8051"}
+	client := &twinClient{twin: 1006, endpoints: []string{blackholed, live.URL}, transport: transport}
+	transport.preferred.Set("1006", blackholed, 0)
+
+	// the preferred endpoint doesn't use up the time of the others
+	start := time.Now()
+	require.NoError(t, client.SendRemote(Message{}))
+	assert.Less(t, int64(time.Since(start)), int64(preferredDialTimeout+time.Second))
+	assert.EqualValues(t, 1, atomic.LoadInt32(count))
+
+	// and is not preferred anymore
+	candidates, preferred := client.candidates()
+	assert.True(t, preferred)
+	assert.Equal(t, live.URL, candidates[0])
+
+	// an unreachable preferred endpoint is forgotten even if no other answers
+	live.Close()
+	transport.preferred.Set("1006", blackholed, 0)
+	assert.Error(t, client.SendRemote(Message{}))
+	_, preferred = client.candidates()
+	assert.False(t, preferred)
+}
+
+func TestTwinClientNoFallbackOnReply(t *testing.T) {
+	refusing, refused := countingServer(http.StatusBadRequest)
+	defer refusing.Close()
+	other, count := countingServer(http.StatusOK)
+	defer other.Close()
+
+	// the twin answered, sending again to another address would duplicate the message
+	client := &twinClient{twin: 1003, endpoints: []string{refusing.URL, other.URL}, transport: sharedDefaultTransport()}
+	client.transport.preferred.Set("1003", refusing.URL, 0)
+	err := client.SendRemote(Message{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "refused")
+	assert.EqualValues(t, 1, atomic.LoadInt32(refused))
+	assert.EqualValues(t, 0, atomic.LoadInt32(count))
+}
+
+func TestTwinClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	cfg := DefaultTransportConfig()
+	cfg.ResponseHeaderTimeout = 100 * time.Millisecond
+	client, err := newTwinClient(testTransport(cfg), 1004, hung.URL)
+	require.NoError(t, err)
+
+	start := time.Now()
+	assert.Error(t, client.SendReply(Message{}))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
@@ -0,0 +1,464 @@
+package rmb
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/substrate-client"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RelayEnvelope is the message of the newer relay based rmb, sent as protobuf
+// over the websocket of the relay. The fields numbers follow its types.proto:
+//
+//	message Request { string command = 1; }
+//	message Response {}
+//	message Error { uint32 code = 1; string message = 2; }
+//	message Address { uint32 twin = 1; optional string connection = 2; }
+//	message Envelope {
+//	    string uid = 1;
+//	    optional string tags = 2;
+//	    uint64 timestamp = 3;
+//	    uint64 expiration = 4;
+//	    Address source = 5;
+//	    Address destination = 6;
+//	    oneof message { Request request = 7; Response response = 8; Error error = 12; }
+//	    optional bytes signature = 9;
+//	    optional string schema = 10;
+//	    optional string federation = 11;
+//	    oneof payload { bytes plain = 13; bytes cipher = 14; }
+//	}
+//
+// The other fields (ping, pong, ...) are skipped when decoding.
+type RelayEnvelope struct {
+	UID         string
+	Tags        string
+	Timestamp   uint64
+	Expiration  uint64
+	Source      RelayAddress
+	Destination RelayAddress
+	// only one of Request, Response and Error is set
+	Request  *RelayRequest
+	Response *RelayResponse
+	Error    *RelayError
+	// Signature is the key type prefix ('e' or 's') followed by the signature
+	Signature  []byte
+	Schema     string
+	Federation string
+	// only one of Plain and Cipher is set
+	Plain  []byte
+	Cipher []byte
+}
+
+// RelayAddress is a twin, and the connection of the twin for the twins
+// connected more than once to the relay
+type RelayAddress struct {
+	Twin       uint32
+	Connection string
+}
+
+func (a RelayAddress) String() string {
+	if a.Connection == "" {
+		return fmt.Sprint(a.Twin)
+	}
+	return fmt.Sprintf("%d:%s", a.Twin, a.Connection)
+}
+
+// RelayRequest is a request to call command on the destination twin
+type RelayRequest struct {
+	Command string
+}
+
+// RelayResponse is the reply of a request, with the same uid
+type RelayResponse struct{}
+
+// RelayError is an error reply, from the destination twin or the relay
+type RelayError struct {
+	Code    uint32
+	Message string
+}
+
+const (
+	envelopeUID         protowire.Number = 1
+	envelopeTags        protowire.Number = 2
+	envelopeTimestamp   protowire.Number = 3
+	envelopeExpiration  protowire.Number = 4
+	envelopeSource      protowire.Number = 5
+	envelopeDestination protowire.Number = 6
+	envelopeRequest     protowire.Number = 7
+	envelopeResponse    protowire.Number = 8
+	envelopeSignature   protowire.Number = 9
+	envelopeSchema      protowire.Number = 10
+	envelopeFederation  protowire.Number = 11
+	envelopeError       protowire.Number = 12
+	envelopePlain       protowire.Number = 13
+	envelopeCipher      protowire.Number = 14
+)
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendMessage appends an embedded message, it's written even if it's empty
+// since an empty message is still set
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+func (a *RelayAddress) marshal() []byte {
+	b := appendVarint(nil, 1, uint64(a.Twin))
+	return appendString(b, 2, a.Connection)
+}
+
+// Marshal encodes the envelope in protobuf
+func (e *RelayEnvelope) Marshal() []byte {
+	b := appendString(nil, envelopeUID, e.UID)
+	b = appendString(b, envelopeTags, e.Tags)
+	b = appendVarint(b, envelopeTimestamp, e.Timestamp)
+	b = appendVarint(b, envelopeExpiration, e.Expiration)
+	b = appendMessage(b, envelopeSource, e.Source.marshal())
+	b = appendMessage(b, envelopeDestination, e.Destination.marshal())
+	switch {
+	case e.Request != nil:
+		b = appendMessage(b, envelopeRequest, appendString(nil, 1, e.Request.Command))
+	case e.Response != nil:
+		b = appendMessage(b, envelopeResponse, nil)
+	case e.Error != nil:
+		m := appendVarint(nil, 1, uint64(e.Error.Code))
+		b = appendMessage(b, envelopeError, appendString(m, 2, e.Error.Message))
+	}
+	if len(e.Signature) != 0 {
+		b = appendMessage(b, envelopeSignature, e.Signature)
+	}
+	b = appendString(b, envelopeSchema, e.Schema)
+	b = appendString(b, envelopeFederation, e.Federation)
+	if e.Cipher != nil {
+		b = appendMessage(b, envelopeCipher, e.Cipher)
+	} else if e.Plain != nil {
+		b = appendMessage(b, envelopePlain, e.Plain)
+	}
+	return b
+}
+
+// consumeFields calls field for each field of the protobuf message b, field
+// returns the size of the value it consumed or a negative size on error
+func consumeFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n = field(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// consumeBytes consumes a length delimited value into v
+func consumeBytes(typ protowire.Type, b []byte, v *[]byte) int {
+	if typ != protowire.BytesType {
+		return protowire.ConsumeFieldValue(0, typ, b)
+	}
+	value, n := protowire.ConsumeBytes(b)
+	if n >= 0 {
+		*v = append([]byte{}, value...)
+	}
+	return n
+}
+
+func consumeString(typ protowire.Type, b []byte, v *string) int {
+	var value []byte
+	n := consumeBytes(typ, b, &value)
+	if n >= 0 && value != nil {
+		*v = string(value)
+	}
+	return n
+}
+
+func consumeVarint(typ protowire.Type, b []byte, v *uint64) int {
+	if typ != protowire.VarintType {
+		return protowire.ConsumeFieldValue(0, typ, b)
+	}
+	value, n := protowire.ConsumeVarint(b)
+	if n >= 0 {
+		*v = value
+	}
+	return n
+}
+
+// consumeMessage consumes an embedded message and decodes its fields
+func consumeMessage(typ protowire.Type, b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) (int, error) {
+	var value []byte
+	n := consumeBytes(typ, b, &value)
+	if n < 0 {
+		return n, nil
+	}
+	return n, consumeFields(value, field)
+}
+
+func (a *RelayAddress) unmarshal(num protowire.Number, typ protowire.Type, b []byte) int {
+	switch num {
+	case 1:
+		var twin uint64
+		n := consumeVarint(typ, b, &twin)
+		a.Twin = uint32(twin)
+		return n
+	case 2:
+		return consumeString(typ, b, &a.Connection)
+	}
+	return protowire.ConsumeFieldValue(num, typ, b)
+}
+
+// UnmarshalRelayEnvelope decodes a protobuf envelope
+func UnmarshalRelayEnvelope(data []byte) (*RelayEnvelope, error) {
+	var e RelayEnvelope
+	var nested error
+	// the embedded messages are decoded right away, their errors are
+	// returned after the envelope one
+	message := func(typ protowire.Type, b []byte, field func(protowire.Number, protowire.Type, []byte) int) int {
+		n, err := consumeMessage(typ, b, field)
+		if err != nil && nested == nil {
+			nested = err
+		}
+		return n
+	}
+
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case envelopeUID:
+			return consumeString(typ, b, &e.UID)
+		case envelopeTags:
+			return consumeString(typ, b, &e.Tags)
+		case envelopeTimestamp:
+			return consumeVarint(typ, b, &e.Timestamp)
+		case envelopeExpiration:
+			return consumeVarint(typ, b, &e.Expiration)
+		case envelopeSource:
+			return message(typ, b, e.Source.unmarshal)
+		case envelopeDestination:
+			return message(typ, b, e.Destination.unmarshal)
+		case envelopeRequest:
+			e.Request, e.Response, e.Error = &RelayRequest{}, nil, nil
+			return message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				if num == 1 {
+					return consumeString(typ, b, &e.Request.Command)
+				}
+				return protowire.ConsumeFieldValue(num, typ, b)
+			})
+		case envelopeResponse:
+			e.Request, e.Response, e.Error = nil, &RelayResponse{}, nil
+			return message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				return protowire.ConsumeFieldValue(num, typ, b)
+			})
+		case envelopeError:
+			e.Request, e.Response, e.Error = nil, nil, &RelayError{}
+			return message(typ, b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case 1:
+					var code uint64
+					n := consumeVarint(typ, b, &code)
+					e.Error.Code = uint32(code)
+					return n
+				case 2:
+					return consumeString(typ, b, &e.Error.Message)
+				}
+				return protowire.ConsumeFieldValue(num, typ, b)
+			})
+		case envelopeSignature:
+			return consumeBytes(typ, b, &e.Signature)
+		case envelopeSchema:
+			return consumeString(typ, b, &e.Schema)
+		case envelopeFederation:
+			return consumeString(typ, b, &e.Federation)
+		case envelopePlain:
+			e.Cipher = nil
+			return consumeBytes(typ, b, &e.Plain)
+		case envelopeCipher:
+			e.Plain = nil
+			return consumeBytes(typ, b, &e.Cipher)
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid envelope")
+	}
+	if nested != nil {
+		return nil, errors.Wrap(nested, "invalid envelope")
+	}
+	return &e, nil
+}
+
+// challenge is the md5 digest of the envelope fields the newer rmb signs, in
+// its order
+func (e *RelayEnvelope) challenge() []byte {
+	hash := md5.New()
+	fmt.Fprintf(hash, "%s", e.UID)
+	if e.Tags != "" {
+		fmt.Fprintf(hash, "%s", e.Tags)
+	}
+	fmt.Fprintf(hash, "%d", e.Timestamp)
+	fmt.Fprintf(hash, "%d", e.Expiration)
+	fmt.Fprintf(hash, "%s", e.Source)
+	fmt.Fprintf(hash, "%s", e.Destination)
+	switch {
+	case e.Request != nil:
+		fmt.Fprintf(hash, "%s", e.Request.Command)
+	case e.Error != nil:
+		fmt.Fprintf(hash, "%d", e.Error.Code)
+		fmt.Fprintf(hash, "%s", e.Error.Message)
+	}
+	if e.Cipher != nil {
+		hash.Write(e.Cipher)
+	} else {
+		hash.Write(e.Plain)
+	}
+	if e.Schema != "" {
+		fmt.Fprintf(hash, "%s", e.Schema)
+	}
+	if e.Federation != "" {
+		fmt.Fprintf(hash, "%s", e.Federation)
+	}
+	return hash.Sum(nil)
+}
+
+// Sign signs the envelope with the identity of its source twin
+func (e *RelayEnvelope) Sign(identity substrate.Identity) error {
+	sig, err := identity.Sign(e.challenge())
+	if err != nil {
+		return err
+	}
+	prefix, err := sigTypeToChar(identity.Type())
+	if err != nil {
+		return err
+	}
+	e.Signature = append([]byte{prefix}, sig...)
+	return nil
+}
+
+// Verify verifies the envelope signature with the public key of its source twin
+func (e *RelayEnvelope) Verify(publicKey []byte) error {
+	return e.verify(publicKey, "")
+}
+
+// verify verifies the envelope signature, twinKeyType is the key type of the
+// source twin if it's known
+func (e *RelayEnvelope) verify(publicKey []byte, twinKeyType string) error {
+	if len(e.Signature) == 0 {
+		return fmt.Errorf("envelope is not signed")
+	}
+	keyType, err := charToSigType(e.Signature[0])
+	if err != nil {
+		return err
+	}
+	verifier, err := constructVerifier(publicKey, keyType, twinKeyType)
+	if err != nil {
+		return err
+	}
+	if !verifier.Verify(e.challenge(), e.Signature[1:]) {
+		return fmt.Errorf("couldn't verify envelope signature")
+	}
+	return nil
+}
+
+// EnvelopeFromMessage translates a message sent to a single twin into the
+// envelope of the newer rmb. The remote messages become requests and the
+// replies responses (or errors if they have one). The return queue is kept in
+// the tags, the peers send them back with the response.
+func EnvelopeFromMessage(msg Message, tag Tag) (*RelayEnvelope, error) {
+	if len(msg.TwinDst) != 1 {
+		return nil, fmt.Errorf("envelope must have exactly one destination, got %d", len(msg.TwinDst))
+	}
+	if msg.Encrypted {
+		// the newer rmb encrypts the payload with its own scheme
+		return nil, fmt.Errorf("encrypted messages can't be sent as envelopes")
+	}
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid message data")
+	}
+	expiration := msg.Expiration
+	if expiration <= 0 {
+		expiration = defaultMessageExpiration
+	}
+
+	envelope := &RelayEnvelope{
+		UID:         msg.ID,
+		Tags:        msg.Retqueue,
+		Timestamp:   uint64(msg.Epoch),
+		Expiration:  uint64(expiration),
+		Source:      RelayAddress{Twin: uint32(msg.TwinSrc)},
+		Destination: RelayAddress{Twin: uint32(msg.TwinDst[0])},
+		Schema:      msg.Schema,
+		Plain:       data,
+	}
+	switch {
+	case tag == Reply && msg.Err != "":
+		envelope.Error = &RelayError{Message: msg.Err}
+	case tag == Reply:
+		envelope.Response = &RelayResponse{}
+	default:
+		envelope.Request = &RelayRequest{Command: msg.Command}
+	}
+	return envelope, nil
+}
+
+// Message translates the envelope into a message, with the tag of the queue it
+// goes to. The message is not signed, the envelope signature is kept so the
+// message can still be told apart from a replay.
+func (e *RelayEnvelope) Message() (Message, Tag, error) {
+	if e.Cipher != nil {
+		return Message{}, 0, fmt.Errorf("encrypted envelopes are not supported")
+	}
+	msg := Message{
+		Version:    ProtocolV2,
+		ID:         e.UID,
+		Expiration: int64(e.Expiration),
+		Data:       base64.StdEncoding.EncodeToString(e.Plain),
+		TwinSrc:    int(e.Source.Twin),
+		TwinDst:    []int{int(e.Destination.Twin)},
+		Retqueue:   e.Tags,
+		Schema:     e.Schema,
+		Epoch:      int64(e.Timestamp),
+		Signature:  hex.EncodeToString(e.Signature),
+	}
+	// the peers of the newer rmb don't need a return queue, the uid is
+	// unique enough
+	if ValidateReturnQueue(msg.Retqueue) != nil {
+		msg.Retqueue = e.UID
+	}
+
+	switch {
+	case e.Request != nil:
+		msg.Command = e.Request.Command
+		return msg, Remote, nil
+	case e.Response != nil:
+		return msg, Reply, nil
+	case e.Error != nil:
+		msg.Err = e.Error.Message
+		if e.Error.Code != 0 {
+			msg.Err = fmt.Sprintf("%s (code %d)", e.Error.Message, e.Error.Code)
+		}
+		return msg, Reply, nil
+	}
+	return Message{}, 0, fmt.Errorf("envelope has no request or response")
+}
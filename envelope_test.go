@@ -0,0 +1,137 @@
+package rmb
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/substrate-client"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestRelayEnvelopeEncoding(t *testing.T) {
+	envelope := RelayEnvelope{
+		UID:         "2.15",
+		Tags:        "msgbus.system.reply",
+		Timestamp:   1660000000,
+		Expiration:  300,
+		Source:      RelayAddress{Twin: 1},
+		Destination: RelayAddress{Twin: 2, Connection: "session"},
+		Request:     &RelayRequest{Command: "zos.statistics.get"},
+		Signature:   []byte{'e', 1, 2, 3},
+		Schema:      "application/json",
+		Federation:  "relay.example.com",
+		Plain:       []byte(`{"key": "value"}`),
+	}
+
+	data := envelope.Marshal()
+	// the first field is the uid: tag (1 << 3 | 2) then the length
+	assert.Equal(t, []byte{0x0a, 4, '2', '.', '1', '5'}, data[:6])
+
+	decoded, err := UnmarshalRelayEnvelope(data)
+	require.NoError(t, err)
+	assert.Equal(t, envelope, *decoded)
+
+	// the fields that are not known are skipped
+	data = protowire.AppendTag(data, 15, protowire.BytesType)
+	data = protowire.AppendBytes(data, nil)
+	data = protowire.AppendTag(data, 17, protowire.VarintType)
+	data = protowire.AppendVarint(data, 7)
+	decoded, err = UnmarshalRelayEnvelope(data)
+	require.NoError(t, err)
+	assert.Equal(t, envelope, *decoded)
+
+	response := RelayEnvelope{UID: "2.15", Response: &RelayResponse{}, Plain: []byte{}}
+	decoded, err = UnmarshalRelayEnvelope(response.Marshal())
+	require.NoError(t, err)
+	assert.NotNil(t, decoded.Response)
+	assert.Nil(t, decoded.Request)
+
+	data = envelope.Marshal()
+	_, err = UnmarshalRelayEnvelope(data[:len(data)-3])
+	assert.Error(t, err)
+}
+
+func TestRelayEnvelopeSignature(t *testing.T) {
+	ed, sr, keys := testIdentities(t)
+
+	for twin, identity := range map[int]substrate.Identity{1: ed, 2: sr} {
+		envelope := RelayEnvelope{
+			UID:         "1",
+			Timestamp:   1660000000,
+			Expiration:  300,
+			Source:      RelayAddress{Twin: uint32(twin)},
+			Destination: RelayAddress{Twin: 3},
+			Request:     &RelayRequest{Command: "zos.statistics.get"},
+			Plain:       []byte("data"),
+		}
+		require.NoError(t, envelope.Sign(identity))
+		require.NoError(t, envelope.Verify(keys[twin]))
+
+		tampered := envelope
+		tampered.Plain = []byte("other")
+		assert.Error(t, tampered.Verify(keys[twin]))
+		tampered = envelope
+		tampered.Request = &RelayRequest{Command: "zos.deployment.delete"}
+		assert.Error(t, tampered.Verify(keys[twin]))
+	}
+
+	unsigned := RelayEnvelope{UID: "1"}
+	assert.Error(t, unsigned.Verify(keys[1]))
+}
+
+func TestEnvelopeFromMessage(t *testing.T) {
+	msg := Message{
+		Version:    ProtocolV2,
+		ID:         "2.15",
+		Command:    "zos.statistics.get",
+		Expiration: 300,
+		Data:       base64.StdEncoding.EncodeToString([]byte("payload")),
+		TwinSrc:    1,
+		TwinDst:    []int{2},
+		Retqueue:   replyQueue,
+		Schema:     "application/json",
+		Epoch:      1660000000,
+	}
+
+	envelope, err := EnvelopeFromMessage(msg, Remote)
+	require.NoError(t, err)
+	assert.Equal(t, "zos.statistics.get", envelope.Request.Command)
+	assert.Equal(t, []byte("payload"), envelope.Plain)
+	assert.Equal(t, replyQueue, envelope.Tags)
+
+	back, tag, err := envelope.Message()
+	require.NoError(t, err)
+	assert.Equal(t, Remote, tag)
+	assert.Equal(t, msg, back)
+
+	msg.Err = "twin not found"
+	envelope, err = EnvelopeFromMessage(msg, Reply)
+	require.NoError(t, err)
+	require.NotNil(t, envelope.Error)
+	back, tag, err = envelope.Message()
+	require.NoError(t, err)
+	assert.Equal(t, Reply, tag)
+	assert.Equal(t, "twin not found", back.Err)
+
+	msg.Err = ""
+	envelope, err = EnvelopeFromMessage(msg, Reply)
+	require.NoError(t, err)
+	assert.NotNil(t, envelope.Response)
+
+	// the peers of the newer rmb don't set a return queue
+	envelope.Tags = ""
+	back, _, err = envelope.Message()
+	require.NoError(t, err)
+	assert.Equal(t, "2.15", back.Retqueue)
+
+	msg.TwinDst = []int{2, 3}
+	_, err = EnvelopeFromMessage(msg, Remote)
+	assert.Error(t, err)
+
+	msg.TwinDst = []int{2}
+	msg.Encrypted = true
+	_, err = EnvelopeFromMessage(msg, Remote)
+	assert.Error(t, err)
+}
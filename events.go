@@ -0,0 +1,136 @@
+package rmb
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/substrate-client"
+)
+
+const (
+	// twins are cached for 5 minutes (~50 blocks), changes older than that can't
+	// be in the cache anymore so there is no need to scan more blocks after a
+	// disconnection
+	maxMissedBlocks = 50
+
+	twinEventsRetry = 10 * time.Second
+)
+
+// TwinEvent is a change of a twin (created, address or account updated, deleted)
+type TwinEvent struct {
+	Twin int
+}
+
+// TwinEventSource streams the twins changes
+type TwinEventSource interface {
+	// Events streams the changes until ctx is canceled, then the channel is closed
+	Events(ctx context.Context) (<-chan TwinEvent, error)
+}
+
+type substrateTwinEvents struct {
+	mgr substrate.Manager
+}
+
+// NewSubstrateTwinEvents streams the twins changes from the chain events, the
+// subscription is restarted if the connection is lost.
+func NewSubstrateTwinEvents(mgr substrate.Manager) TwinEventSource {
+	return &substrateTwinEvents{mgr: mgr}
+}
+
+func (s *substrateTwinEvents) Events(ctx context.Context) (<-chan TwinEvent, error) {
+	ch := make(chan TwinEvent)
+	go s.run(ctx, ch)
+	return ch, nil
+}
+
+func (s *substrateTwinEvents) run(ctx context.Context, ch chan<- TwinEvent) {
+	defer close(ch)
+
+	var last uint32
+	for {
+		err := s.follow(ctx, &last, ch)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Error().Err(err).Msg("twin events subscription failed, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(twinEventsRetry):
+		}
+	}
+}
+
+// follow processes the events of each new block, last is the last processed
+// block so the missed blocks are processed after a reconnection
+func (s *substrateTwinEvents) follow(ctx context.Context, last *uint32, ch chan<- TwinEvent) error {
+	sub, err := s.mgr.Substrate()
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to substrate")
+	}
+	defer sub.Close()
+
+	cl, _, err := sub.GetClient()
+	if err != nil {
+		return err
+	}
+	heads, err := cl.RPC.Chain.SubscribeNewHeads()
+	if err != nil {
+		return errors.Wrap(err, "failed to subscribe to new blocks")
+	}
+	defer heads.Unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-heads.Err():
+			return err
+		case head := <-heads.Chan():
+			number := uint32(head.Number)
+			from := *last + 1
+			if *last == 0 {
+				from = number
+			} else if number > *last+maxMissedBlocks {
+				from = number - maxMissedBlocks + 1
+			}
+
+			for block := from; block <= number; block++ {
+				if err := s.processBlock(ctx, sub, block, ch); err != nil {
+					return errors.Wrapf(err, "failed to process block %d", block)
+				}
+				*last = block
+			}
+		}
+	}
+}
+
+func (s *substrateTwinEvents) processBlock(ctx context.Context, sub *substrate.Substrate, block uint32, ch chan<- TwinEvent) error {
+	events, err := sub.GetEventsForBlock(block)
+	if err != nil {
+		return err
+	}
+
+	var twins []int
+	for _, event := range events.TfgridModule_TwinStored {
+		twins = append(twins, int(event.Twin.ID))
+	}
+	for _, event := range events.TfgridModule_TwinUpdated {
+		twins = append(twins, int(event.Twin.ID))
+	}
+	for _, event := range events.TfgridModule_TwinDeleted {
+		twins = append(twins, int(event.Twin))
+	}
+
+	for _, twin := range twins {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ch <- TwinEvent{Twin: twin}:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package rmb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTwinEvents chan TwinEvent
+
+func (f fakeTwinEvents) Events(ctx context.Context) (<-chan TwinEvent, error) {
+	out := make(chan TwinEvent)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-f:
+				out <- event
+			}
+		}
+	}()
+	return out, nil
+}
+
+func TestTwinEventsEvictCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	inner := NewMockTwinResolver(ctrl)
+	old := &twinClient{endpoints: []string{"http://10.0.0.1:8051"}}
+	updated := &twinClient{endpoints: []string{"http://10.0.0.2:8051"}}
+	other := &twinClient{endpoints: []string{"http://10.0.0.3:8051"}}
+	gomock.InOrder(
+		inner.EXPECT().Resolve(1).Return(old, nil),
+		inner.EXPECT().Resolve(1).Return(updated, nil),
+	)
+	inner.EXPECT().Resolve(2).Return(other, nil).Times(1)
+
+	events := make(fakeTwinEvents)
+	app := App{
+		resolver: NewChainedResolver(NewCacheResolver(inner, time.Minute)),
+		events:   events,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, app.followTwinEvents(ctx))
+
+	for _, twin := range []int{1, 2} {
+		_, err := app.resolver.Resolve(twin)
+		require.NoError(t, err)
+	}
+
+	// only the changed twin is resolved again
+	events <- TwinEvent{Twin: 1}
+	assert.Eventually(t, func() bool {
+		client, err := app.resolver.Resolve(1)
+		return err == nil && client == updated
+	}, time.Second, 10*time.Millisecond)
+
+	client, err := app.resolver.Resolve(2)
+	require.NoError(t, err)
+	assert.Equal(t, other, client)
+}
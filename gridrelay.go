@@ -0,0 +1,370 @@
+package rmb
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/substrate-client"
+)
+
+// The grid relay is the relay of the newer rmb. The twins keep a websocket open
+// to it, authenticated with a token signed by the twin, and exchange protobuf
+// envelopes (see RelayEnvelope) that the relay routes by destination twin. The
+// twins using it have a `ws://` or `wss://` address, the url of their relay.
+const (
+	gridRelayTokenLifetime = time.Minute
+	// gridRelayRouteTTL is how long the connection of a request is kept for
+	// its reply
+	gridRelayRouteTTL = time.Hour
+	// gridRelayMaxInflight is the number of envelopes handled at once, the
+	// relay connection is not read while they are all busy
+	gridRelayMaxInflight = 64
+)
+
+// gridRelayToken builds the JWT the twin connects to the relay with. Like the
+// newer rmb, the signature is prefixed with the key type.
+func gridRelayToken(identity substrate.Identity, twin int) (string, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	header, err := json.Marshal(map[string]string{"alg": "RS512", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims, err := json.Marshal(map[string]int64{
+		"sub": int64(twin),
+		"iat": now.Unix(),
+		"exp": now.Add(gridRelayTokenLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	token := encode(header) + "." + encode(claims)
+	sig, err := identity.Sign([]byte(token))
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't sign relay token")
+	}
+	prefix, err := sigTypeToChar(identity.Type())
+	if err != nil {
+		return "", err
+	}
+	return token + "." + encode(append([]byte{prefix}, sig...)), nil
+}
+
+// gridRelay is the connection of this twin to its grid relay
+type gridRelay struct {
+	url      string
+	host     string
+	identity substrate.Identity
+	twin     int
+	timeout  time.Duration
+
+	m    sync.Mutex
+	conn *websocket.Conn
+	// connections keeps the connection of the twins the requests came from,
+	// so the replies go back to it
+	connections *cache.Cache
+}
+
+func newGridRelay(address string, identity substrate.Identity, twin int, timeout time.Duration) (*gridRelay, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid relay url")
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("relay url '%s' must be a ws or wss url", address)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in relay url '%s'", address)
+	}
+	return &gridRelay{
+		url:         strings.TrimSuffix(address, "/"),
+		host:        u.Hostname(),
+		identity:    identity,
+		twin:        twin,
+		timeout:     timeout,
+		connections: cache.New(gridRelayRouteTTL, 10*time.Minute),
+	}, nil
+}
+
+// send signs the envelope and sends it to the relay
+func (g *gridRelay) send(envelope *RelayEnvelope) error {
+	if err := envelope.Sign(g.identity); err != nil {
+		return errors.Wrap(err, "couldn't sign envelope")
+	}
+	data := envelope.Marshal()
+
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.conn == nil {
+		return unreachableError{errors.Wrapf(ErrTwinUnreachable, "not connected to relay %s", g.host)}
+	}
+	g.conn.SetWriteDeadline(time.Now().Add(g.timeout))
+	if err := g.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		g.conn.Close()
+		return unreachableError{errors.Wrapf(err, "couldn't send to relay %s", g.host)}
+	}
+	return nil
+}
+
+// received records the connection a request was received from
+func (g *gridRelay) received(envelope *RelayEnvelope) {
+	if envelope.Request != nil && envelope.Source.Connection != "" {
+		key := fmt.Sprintf("%d/%s", envelope.Source.Twin, envelope.UID)
+		g.connections.Set(key, envelope.Source.Connection, cache.DefaultExpiration)
+	}
+}
+
+// serve reads the envelopes of the connection until it's closed
+func (g *gridRelay) serve(ctx context.Context, conn *websocket.Conn, handle func(data []byte)) error {
+	g.m.Lock()
+	g.conn = conn
+	g.m.Unlock()
+
+	closed := make(chan struct{})
+	defer func() {
+		close(closed)
+		g.m.Lock()
+		g.conn = nil
+		g.m.Unlock()
+		conn.Close()
+	}()
+
+	extend := func() {
+		conn.SetReadDeadline(time.Now().Add(linkReadTimeout))
+	}
+	extend()
+	conn.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(linkPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-closed:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(g.timeout)); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	inflight := make(chan struct{}, gridRelayMaxInflight)
+	for {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		extend()
+		if typ != websocket.BinaryMessage {
+			continue
+		}
+		inflight <- struct{}{}
+		go func() {
+			defer func() { <-inflight }()
+			handle(data)
+		}()
+	}
+}
+
+// gridClient sends the messages of a twin over the grid relay
+type gridClient struct {
+	relay *gridRelay
+	twin  int
+	// federation is the relay of the twin, if it's not the relay of this twin
+	federation string
+}
+
+func (c *gridClient) send(msg Message, tag Tag) error {
+	envelope, err := EnvelopeFromMessage(msg, tag)
+	if err != nil {
+		return err
+	}
+	envelope.Federation = c.federation
+	if tag == Reply {
+		if connection, ok := c.relay.connections.Get(fmt.Sprintf("%d/%s", c.twin, msg.ID)); ok {
+			envelope.Destination.Connection = connection.(string)
+		}
+	}
+	return c.relay.send(envelope)
+}
+
+func (c *gridClient) SendRemote(msg Message) error {
+	return c.send(msg, Remote)
+}
+
+func (c *gridClient) SendReply(msg Message) error {
+	return c.send(msg, Reply)
+}
+
+// gridTransport sends the messages to the twins with a `ws://` or `wss://`
+// address over the grid relay
+type gridTransport struct {
+	relay *gridRelay
+}
+
+func (t gridTransport) NewClient(twin int, endpoints []string) (TwinClient, error) {
+	client := &gridClient{relay: t.relay, twin: twin}
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid relay address '%s'", endpoint)
+		}
+		if u.Hostname() == t.relay.host {
+			client.federation = ""
+			break
+		}
+		if client.federation == "" {
+			client.federation = u.Hostname()
+		}
+	}
+	return client, nil
+}
+
+// envelopeDelivery is the context key set on the messages received from the
+// grid relay, their envelope signature was already verified
+type envelopeDelivery struct{}
+
+func isEnvelopeDelivery(ctx context.Context) bool {
+	delivered, _ := ctx.Value(envelopeDelivery{}).(bool)
+	return delivered
+}
+
+// websocketDialer dials the websockets to the peers and relays with the peer
+// transport dialer
+func (a *App) websocketDialer() *websocket.Dialer {
+	dialer := &websocket.Dialer{
+		NetDialContext:   a.peers.dialer.DialContext,
+		HandshakeTimeout: linkHandshakeTimeout,
+	}
+	if a.transport.Proxy.URL == "" {
+		dialer.Proxy = http.ProxyFromEnvironment
+	}
+	return dialer
+}
+
+// dialGridRelay connects this twin to its grid relay
+func (a *App) dialGridRelay(ctx context.Context) (*websocket.Conn, error) {
+	token, err := gridRelayToken(a.identity, a.twin)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, linkHandshakeTimeout)
+	defer cancel()
+
+	conn, resp, err := a.websocketDialer().DialContext(ctx, a.gridRelay.url+"/?"+token, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("relay refused the connection: %s", resp.Status)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// keepGridRelay keeps this twin connected to its grid relay, the connection is
+// opened again with an exponential backoff when it's closed
+func (a *App) keepGridRelay(ctx context.Context) {
+	backoff := linkBackoffMin
+	for {
+		conn, err := a.dialGridRelay(ctx)
+		if err == nil {
+			backoff = linkBackoffMin
+			log.Info().Str("relay", a.gridRelay.host).Msg("connected to grid relay")
+			err = a.gridRelay.serve(ctx, conn, func(data []byte) {
+				a.handleEnvelope(ctx, data)
+			})
+			log.Info().Err(err).Str("relay", a.gridRelay.host).Msg("grid relay connection closed")
+		} else {
+			log.Warn().Err(err).Str("relay", a.gridRelay.host).Msg("couldn't connect to grid relay")
+		}
+
+		var ok bool
+		if backoff, ok = waitBackoff(ctx, backoff); !ok {
+			return
+		}
+	}
+}
+
+// handleEnvelope verifies an envelope received from the grid relay and delivers
+// it like the messages received from the other twins. The requests that can't
+// be delivered get an error response.
+func (a *App) handleEnvelope(ctx context.Context, data []byte) {
+	envelope, err := UnmarshalRelayEnvelope(data)
+	if err != nil {
+		log.Warn().Err(err).Msg("invalid envelope from grid relay")
+		return
+	}
+	src := int(envelope.Source.Twin)
+	if len(envelope.Signature) == 0 && envelope.Error != nil {
+		// the errors of the relay itself are not signed, they can't be
+		// trusted as the reply of the twin
+		log.Warn().Str("id", envelope.UID).Int("dst", src).Str("error", envelope.Error.Message).Msg("grid relay error")
+		return
+	}
+	if int(envelope.Destination.Twin) != a.twin {
+		log.Warn().Str("id", envelope.UID).Uint32("dst", envelope.Destination.Twin).Msg("envelope is not for this twin")
+		return
+	}
+
+	pk, keyType, err := a.twinKey(src)
+	if err != nil {
+		log.Warn().Err(err).Str("id", envelope.UID).Int("src", src).Msg("couldn't get envelope source public key")
+		return
+	}
+	if err := envelope.verify(pk, keyType); err != nil {
+		a.invalidateKey(src)
+		log.Warn().Err(err).Str("id", envelope.UID).Int("src", src).Msg("invalid envelope signature")
+		return
+	}
+	a.gridRelay.received(envelope)
+
+	status, reason := http.StatusBadRequest, ""
+	msg, tag, err := envelope.Message()
+	if err != nil {
+		reason = err.Error()
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, a.transport.RequestTimeout)
+		defer cancel()
+		status, reason = a.deliver(context.WithValue(ctx, envelopeDelivery{}, true), tagKind(tag), &msg)
+	}
+	if status == http.StatusOK {
+		return
+	}
+	log.Debug().Str("id", envelope.UID).Int("src", src).Int("status", status).Str("error", reason).Msg("refused envelope")
+	if envelope.Request == nil {
+		return
+	}
+
+	response := &RelayEnvelope{
+		UID:         envelope.UID,
+		Tags:        envelope.Tags,
+		Timestamp:   uint64(time.Now().Unix()),
+		Expiration:  envelope.Expiration,
+		Source:      RelayAddress{Twin: uint32(a.twin)},
+		Destination: envelope.Source,
+		Error:       &RelayError{Code: uint32(status), Message: reason},
+	}
+	if err := a.gridRelay.send(response); err != nil {
+		log.Warn().Err(err).Str("id", envelope.UID).Int("dst", src).Msg("couldn't send error response")
+	}
+}
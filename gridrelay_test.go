@@ -0,0 +1,251 @@
+package rmb
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/substrate-client"
+)
+
+// standInRelay routes the envelopes between the connected twins like the relay
+// of the newer rmb
+type standInRelay struct {
+	keys testKeys
+
+	m     sync.Mutex
+	twins map[uint32]*relayPeer
+}
+
+type relayPeer struct {
+	m    sync.Mutex
+	conn *websocket.Conn
+}
+
+func (p *relayPeer) write(data []byte) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// authenticate verifies the token of a twin
+func (s *standInRelay) authenticate(token string) (uint32, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid token")
+	}
+	var claims struct {
+		Sub uint32 `json:"sub"`
+		Exp int64  `json:"exp"`
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return 0, err
+	}
+	if claims.Exp < time.Now().Unix() {
+		return 0, fmt.Errorf("token expired")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) == 0 {
+		return 0, fmt.Errorf("invalid signature")
+	}
+	keyType, err := charToSigType(sig[0])
+	if err != nil {
+		return 0, err
+	}
+	verifier, err := constructVerifier(s.keys[int(claims.Sub)], keyType, "")
+	if err != nil {
+		return 0, err
+	}
+	if !verifier.Verify([]byte(parts[0]+"."+parts[1]), sig[1:]) {
+		return 0, fmt.Errorf("invalid signature")
+	}
+	return claims.Sub, nil
+}
+
+func (s *standInRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	twin, err := s.authenticate(r.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	peer := &relayPeer{conn: conn}
+	s.m.Lock()
+	s.twins[twin] = peer
+	s.m.Unlock()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		envelope, err := UnmarshalRelayEnvelope(data)
+		if err != nil {
+			return
+		}
+		s.m.Lock()
+		dst, ok := s.twins[envelope.Destination.Twin]
+		s.m.Unlock()
+		if !ok {
+			// the relay errors are not signed
+			reply := RelayEnvelope{
+				UID:         envelope.UID,
+				Source:      envelope.Destination,
+				Destination: envelope.Source,
+				Error:       &RelayError{Code: 404, Message: "twin not connected"},
+			}
+			peer.write(reply.Marshal())
+			continue
+		}
+		dst.write(data)
+	}
+}
+
+func (s *standInRelay) connected(twin uint32) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, ok := s.twins[twin]
+	return ok
+}
+
+// gridPeer is a twin of the newer rmb connected to the relay
+func gridPeer(t *testing.T, url string, identity substrate.Identity, twin int) *websocket.Conn {
+	token, err := gridRelayToken(identity, twin)
+	require.NoError(t, err)
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/?"+token, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readEnvelope(t *testing.T, conn *websocket.Conn) *RelayEnvelope {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	envelope, err := UnmarshalRelayEnvelope(data)
+	require.NoError(t, err)
+	return envelope
+}
+
+func TestGridRelay(t *testing.T) {
+	ed, sr, keys := testIdentities(t)
+	relay := &standInRelay{keys: keys, twins: make(map[uint32]*relayPeer)}
+	server := httptest.NewServer(relay)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	app, _ := linkApp(ed, 1, keys)
+	var err error
+	app.gridRelay, err = newGridRelay(url, ed, 1, time.Second)
+	require.NoError(t, err)
+	app.peers.registry.register(gridTransport{app.gridRelay}, "ws", "wss")
+
+	// the tokens are checked by the relay
+	_, _, err = websocket.DefaultDialer.Dial(url+"/?invalid", nil)
+	require.Error(t, err)
+
+	peer := gridPeer(t, url, sr, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.keepGridRelay(ctx)
+	for i := 0; i < 100 && !relay.connected(1); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.True(t, relay.connected(1))
+
+	// the twin on the newer rmb gets a signed request, through its own relay
+	client, err := app.peers.registry.newClient(2, []string{"wss://relay.example.com"})
+	require.NoError(t, err)
+	msg := linkMessage(t, ed, 1, 2)
+	msg.Data = base64.StdEncoding.EncodeToString([]byte("payload"))
+	require.Eventually(t, func() bool { return client.SendRemote(msg) == nil }, 2*time.Second, 20*time.Millisecond)
+
+	request := readEnvelope(t, peer)
+	require.NoError(t, request.Verify(keys[1]))
+	require.NotNil(t, request.Request)
+	assert.Equal(t, msg.ID, request.UID)
+	assert.Equal(t, msg.Command, request.Request.Command)
+	assert.Equal(t, []byte("payload"), request.Plain)
+	assert.Equal(t, "relay.example.com", request.Federation)
+	assert.Equal(t, uint32(2), request.Destination.Twin)
+
+	// a request the go twin refuses gets an error response
+	refused := RelayEnvelope{
+		UID:         "refused",
+		Timestamp:   uint64(time.Now().Unix()),
+		Expiration:  60,
+		Source:      RelayAddress{Twin: 2, Connection: "session"},
+		Destination: RelayAddress{Twin: 1},
+		Request:     &RelayRequest{Command: "invalid command"},
+		Plain:       []byte{},
+	}
+	require.NoError(t, refused.Sign(sr))
+	require.NoError(t, peer.WriteMessage(websocket.BinaryMessage, refused.Marshal()))
+
+	response := readEnvelope(t, peer)
+	require.NoError(t, response.Verify(keys[1]))
+	require.NotNil(t, response.Error)
+	assert.Equal(t, "refused", response.UID)
+	assert.Equal(t, uint32(http.StatusForbidden), response.Error.Code)
+	assert.Equal(t, RelayAddress{Twin: 2, Connection: "session"}, response.Destination)
+}
+
+func TestHandleEnvelope(t *testing.T) {
+	ed, sr, keys := testIdentities(t)
+	app, backend := linkApp(ed, 1, keys)
+	var err error
+	app.gridRelay, err = newGridRelay("wss://relay.example.com", ed, 1, time.Second)
+	require.NoError(t, err)
+
+	request := RelayEnvelope{
+		UID:         "request",
+		Timestamp:   uint64(time.Now().Unix()),
+		Expiration:  60,
+		Source:      RelayAddress{Twin: 2, Connection: "session"},
+		Destination: RelayAddress{Twin: 1},
+		Request:     &RelayRequest{Command: "zos.statistics.get"},
+		Plain:       []byte("payload"),
+	}
+	require.NoError(t, request.Sign(sr))
+	app.handleEnvelope(context.Background(), request.Marshal())
+
+	require.Len(t, backend.remotes, 1)
+	remote := backend.remotes[0]
+	assert.Equal(t, "zos.statistics.get", remote.Command)
+	assert.Equal(t, 2, remote.TwinSrc)
+	assert.Equal(t, "request", remote.Retqueue)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("payload")), remote.Data)
+
+	// the reply goes back to the connection of the request
+	connection, ok := app.gridRelay.connections.Get("2/request")
+	require.True(t, ok)
+	assert.Equal(t, "session", connection)
+	// but the twin is only reached over the relay if its address is a relay
+	_, err = app.resolve(2)
+	assert.Error(t, err)
+
+	// replayed and forged envelopes are dropped
+	app.handleEnvelope(context.Background(), request.Marshal())
+	forged := request
+	forged.UID = "forged"
+	app.handleEnvelope(context.Background(), forged.Marshal())
+	assert.Len(t, backend.remotes, 1)
+}
@@ -0,0 +1,151 @@
+package rmb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// InProcessTransport connects rmb servers running in the same process, with
+// addresses like `inproc://<name>`. It's meant for tests running several twins
+// in one binary: each server listens with Listen (see WithListener), and the
+// transport is registered for the `inproc` scheme (see WithTwinTransport).
+type InProcessTransport struct {
+	m         sync.Mutex
+	listeners map[string]*pipeListener
+	client    *http.Client
+	timeout   time.Duration
+}
+
+// NewInProcessTransport creates an in-process transport
+func NewInProcessTransport() *InProcessTransport {
+	t := &InProcessTransport{
+		listeners: make(map[string]*pipeListener),
+		timeout:   DefaultTransportConfig().RequestTimeout,
+	}
+	t.client = &http.Client{
+		Transport: &http.Transport{DialContext: t.dial},
+	}
+	return t
+}
+
+// Listen creates the listener of the server reachable at `inproc://<name>`
+func (t *InProcessTransport) Listen(name string) (net.Listener, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if _, ok := t.listeners[name]; ok {
+		return nil, fmt.Errorf("in-process address '%s' is already used", name)
+	}
+	l := &pipeListener{
+		name:  name,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	l.closed = func() {
+		t.m.Lock()
+		defer t.m.Unlock()
+		delete(t.listeners, name)
+	}
+	t.listeners[name] = l
+	return l, nil
+}
+
+// dial connects to the listener of the request host
+func (t *InProcessTransport) dial(ctx context.Context, _, address string) (net.Conn, error) {
+	name, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	t.m.Lock()
+	l, ok := t.listeners[name]
+	t.m.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("in-process address '%s' is not listening", name)
+	}
+	return l.dial(ctx)
+}
+
+// NewClient implements TwinTransport
+func (t *InProcessTransport) NewClient(twin int, endpoints []string) (TwinClient, error) {
+	var clients fallbackClient
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid in-process address '%s', expected inproc://<name>", endpoint)
+		}
+		clients = append(clients, &connClient{
+			twin:    twin,
+			base:    fmt.Sprintf("http://%s%s", u.Host, u.Path),
+			client:  t.client,
+			timeout: t.timeout,
+		})
+	}
+	if len(clients) == 1 {
+		return clients[0], nil
+	}
+	return clients, nil
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "inproc"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+// pipeListener accepts the in-process connections made with net.Pipe
+type pipeListener struct {
+	name   string
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+	closed func()
+}
+
+func (l *pipeListener) dial(ctx context.Context) (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+	case <-ctx.Done():
+	}
+	server.Close()
+	client.Close()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, fmt.Errorf("in-process address '%s' is closed", l.name)
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.closed()
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
@@ -0,0 +1,653 @@
+package rmb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/substrate-client"
+)
+
+// A peer link is a long lived WebSocket between two rmb servers, opened by a
+// twin that can't be reached directly (behind NAT) to a peer. Once both twins
+// proved their identity by signing both nonces and both twin ids, each under
+// the domain of its own role, the remote and reply messages between them flow
+// both ways over the link. Each message is acknowledged by uid with the status
+// the http endpoint would have returned.
+const (
+	linkPath = "/zbus-link"
+	// the domains of the signatures of the side that accepted the link and the
+	// side that opened it, so a signature of one role can't be replayed as the
+	// other
+	linkServerDomain = "rmb.link.v2.server"
+	linkClientDomain = "rmb.link.v2.client"
+
+	linkNonceSize        = 32
+	linkHandshakeTimeout = 10 * time.Second
+	linkPingInterval     = 30 * time.Second
+	linkReadTimeout      = 2 * linkPingInterval
+	linkBackoffMin       = time.Second
+	linkBackoffMax       = time.Minute
+	// linkMaxInflight is the number of messages of a link handled at once,
+	// the link is not read while they are all busy
+	linkMaxInflight = 64
+)
+
+const (
+	linkHello     = "hello"
+	linkChallenge = "challenge"
+	linkAuth      = "auth"
+	linkReady     = "ready"
+	linkError     = "error"
+	linkRemote    = "remote"
+	linkReply     = "reply"
+	linkAck       = "ack"
+)
+
+// linkFrame is a frame sent over a peer link
+type linkFrame struct {
+	Type string `json:"type"`
+	// handshake
+	Twin      int    `json:"twin,omitempty"`
+	Nonce     []byte `json:"nonce,omitempty"`
+	Signature string `json:"sig,omitempty"`
+	// messages and their acknowledgment
+	UID     string   `json:"uid,omitempty"`
+	Kind    string   `json:"kind,omitempty"`
+	Message *Message `json:"msg,omitempty"`
+	Status  int      `json:"status,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// linkPayload is what a twin signs to prove its identity to a peer, domain is
+// the role of the signer. The payload binds the twins on both ends and the
+// nonces of both of them to the handshake.
+func linkPayload(domain string, client, server int, clientNonce, serverNonce []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(domain)
+	var id [8]byte
+	for _, twin := range []int{client, server} {
+		binary.BigEndian.PutUint64(id[:], uint64(twin))
+		buf.Write(id[:])
+	}
+	buf.Write(clientNonce)
+	buf.Write(serverNonce)
+	return buf.Bytes()
+}
+
+// signPayload signs a handshake payload with the twin identity, the signature
+// is prefixed with the key type like the messages signature
+func signPayload(identity substrate.Identity, payload []byte) (string, error) {
+	sig, err := identity.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	prefix, err := sigTypeToChar(identity.Type())
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(append([]byte{prefix}, sig...)), nil
+}
+
+// verifyPayload verifies a signature made with signPayload, twinKeyType is the
+// key type of the signer if it's known
+func verifyPayload(publicKey []byte, twinKeyType string, payload []byte, signature string) error {
+	decoded, err := decodeSignature(signature)
+	if err != nil || len(decoded) == 0 {
+		return errors.Wrap(ErrPeerNotVerified, "invalid signature")
+	}
+	keyType, err := charToSigType(decoded[0])
+	if err != nil {
+		return errors.Wrap(ErrPeerNotVerified, err.Error())
+	}
+	verifier, err := constructVerifier(publicKey, keyType, twinKeyType)
+	if err != nil {
+		return errors.Wrap(ErrPeerNotVerified, err.Error())
+	}
+	if !verifier.Verify(payload, decoded[1:]) {
+		return errors.Wrap(ErrPeerNotVerified, "couldn't verify signature")
+	}
+	return nil
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, linkNonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// linkURL builds the url of the link endpoint of a peer from its address, the
+// http addresses are mapped to their WebSocket scheme
+func linkURL(address string) (string, error) {
+	base, err := parseTwinAddress(address)
+	if err != nil {
+		return "", err
+	}
+	switch endpointScheme(base) {
+	case "http":
+		base = "ws" + strings.TrimPrefix(base, "http")
+	case "https":
+		base = "wss" + strings.TrimPrefix(base, "https")
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("link address '%s' must be a http or ws url", address)
+	}
+	return base + linkPath, nil
+}
+
+// peerLink is an established link to a twin, it implements TwinClient
+type peerLink struct {
+	twin    int
+	conn    *websocket.Conn
+	timeout time.Duration
+	// relay is set on the link to the relay of this twin, which delivers the
+	// messages of all the twins
+	relay bool
+
+	wm      sync.Mutex
+	m       sync.Mutex
+	pending map[string]chan linkFrame
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newPeerLink(twin int, conn *websocket.Conn, timeout time.Duration) *peerLink {
+	return &peerLink{
+		twin:    twin,
+		conn:    conn,
+		timeout: timeout,
+		pending: make(map[string]chan linkFrame),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (l *peerLink) write(frame linkFrame) error {
+	l.wm.Lock()
+	defer l.wm.Unlock()
+
+	l.conn.SetWriteDeadline(time.Now().Add(l.timeout))
+	return l.conn.WriteJSON(frame)
+}
+
+// pendingKey identifies a message waiting for its acknowledgment, the uid is
+// only unique for its source twin
+func pendingKey(kind string, src int, uid string) string {
+	return fmt.Sprintf("%s:%d:%s", kind, src, uid)
+}
+
+// ackError is an error acknowledged by the peer for a message
+type ackError struct {
+	status  int
+	message string
+}
+
+func (e ackError) Error() string {
+	return fmt.Sprintf("failed to send remote: %d %s (%s)", e.status, http.StatusText(e.status), e.message)
+}
+
+// send sends the message over the link and waits for the peer to acknowledge it
+func (l *peerLink) send(kind string, msg Message) error {
+	key := pendingKey(kind, msg.TwinSrc, msg.ID)
+	ack := make(chan linkFrame, 1)
+	l.m.Lock()
+	if _, ok := l.pending[key]; ok {
+		l.m.Unlock()
+		return fmt.Errorf("message %s is already in flight to twin %d", msg.ID, l.twin)
+	}
+	l.pending[key] = ack
+	l.m.Unlock()
+
+	defer func() {
+		l.m.Lock()
+		defer l.m.Unlock()
+		delete(l.pending, key)
+	}()
+
+	if err := l.write(linkFrame{Type: kind, UID: msg.ID, Message: &msg}); err != nil {
+		l.close()
+		return unreachableError{errors.Wrapf(err, "couldn't send to twin %d over link", l.twin)}
+	}
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case frame := <-ack:
+		if frame.Status != http.StatusOK {
+			return ackError{status: frame.Status, message: frame.Error}
+		}
+		return nil
+	case <-l.closed:
+		return unreachableError{fmt.Errorf("link to twin %d is closed", l.twin)}
+	case <-timer.C:
+		return unreachableError{fmt.Errorf("twin %d didn't acknowledge message %s", l.twin, msg.ID)}
+	}
+}
+
+func (l *peerLink) SendRemote(msg Message) error {
+	return l.send(linkRemote, msg)
+}
+
+func (l *peerLink) SendReply(msg Message) error {
+	return l.send(linkReply, msg)
+}
+
+func (l *peerLink) acknowledge(frame linkFrame) {
+	l.m.Lock()
+	ack, ok := l.pending[pendingKey(frame.Kind, frame.Twin, frame.UID)]
+	l.m.Unlock()
+	if !ok {
+		log.Debug().Int("twin", l.twin).Str("uid", frame.UID).Msg("acknowledgment of unknown message")
+		return
+	}
+	select {
+	case ack <- frame:
+	default:
+	}
+}
+
+func (l *peerLink) close() {
+	l.once.Do(func() {
+		close(l.closed)
+		l.conn.Close()
+	})
+}
+
+// run reads the frames until the link is closed, the received messages are
+// given to handle and its result is sent back as acknowledgment
+func (l *peerLink) run(handle func(frame linkFrame) linkFrame) error {
+	defer l.close()
+
+	extend := func() {
+		l.conn.SetReadDeadline(time.Now().Add(linkReadTimeout))
+	}
+	extend()
+	l.conn.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(linkPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.closed:
+				return
+			case <-ticker.C:
+				if err := l.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(l.timeout)); err != nil {
+					l.close()
+					return
+				}
+			}
+		}
+	}()
+
+	inflight := make(chan struct{}, linkMaxInflight)
+	for {
+		var frame linkFrame
+		if err := l.conn.ReadJSON(&frame); err != nil {
+			return err
+		}
+		extend()
+
+		switch frame.Type {
+		case linkAck:
+			l.acknowledge(frame)
+		case linkRemote, linkReply:
+			inflight <- struct{}{}
+			go func() {
+				defer func() { <-inflight }()
+				if err := l.write(handle(frame)); err != nil {
+					l.close()
+				}
+			}()
+		default:
+			log.Debug().Int("twin", l.twin).Str("type", frame.Type).Msg("unexpected link frame")
+		}
+	}
+}
+
+// peerLinks are the established links by twin
+type peerLinks struct {
+	m     sync.RWMutex
+	links map[int]*peerLink
+}
+
+func newPeerLinks() *peerLinks {
+	return &peerLinks{links: make(map[int]*peerLink)}
+}
+
+func (p *peerLinks) get(twin int) (*peerLink, bool) {
+	if p == nil {
+		return nil, false
+	}
+	p.m.RLock()
+	defer p.m.RUnlock()
+	link, ok := p.links[twin]
+	return link, ok
+}
+
+// add sets the link of its twin, an older link to the same twin is closed
+func (p *peerLinks) add(link *peerLink) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if old, ok := p.links[link.twin]; ok {
+		old.close()
+	}
+	p.links[link.twin] = link
+}
+
+func (p *peerLinks) remove(link *peerLink) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if current, ok := p.links[link.twin]; ok && current == link {
+		delete(p.links, link.twin)
+	}
+}
+
+func (p *peerLinks) closeAll() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for _, link := range p.links {
+		link.close()
+	}
+}
+
+// resolve returns the client of a twin, over its link if there is one. The
+// twins with a relay address are reached over the grid relay by their
+// transport.
+func (a *App) resolve(twin int) (TwinClient, error) {
+	if link, ok := a.links.get(twin); ok {
+		return link, nil
+	}
+	return a.resolver.Resolve(twin)
+}
+
+// linkPeer is the context key of the link a message was received on
+type linkPeer struct{}
+
+// linkResponse records the reply of the http handlers to a link message
+type linkResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *linkResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *linkResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *linkResponse) Write(data []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(data)
+}
+
+// deliver gives a message received from a link or a relay to the handler of
+// its http endpoint, and returns the http status and error message
+func (a *App) deliver(ctx context.Context, kind string, msg *Message) (int, string) {
+	body, err := json.Marshal(msg)
+	if err != nil || msg == nil {
+		return http.StatusBadRequest, "invalid message"
+	}
+
+	handler, path := a.remote, "/zbus-remote"
+	if kind == linkReply {
+		handler, path = a.reply, "/zbus-reply"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	response := linkResponse{header: make(http.Header)}
+	handler(&response, req)
+	if response.status != http.StatusOK {
+		return response.status, readError(&response.body)
+	}
+	return http.StatusOK, ""
+}
+
+// handleLinkFrame delivers a message received over the link, and returns the
+// acknowledgment
+func (a *App) handleLinkFrame(link *peerLink, frame linkFrame) linkFrame {
+	ack := linkFrame{Type: linkAck, UID: frame.UID, Kind: frame.Type}
+	if frame.Message == nil {
+		ack.Status, ack.Error = http.StatusBadRequest, "invalid message"
+		return ack
+	}
+	ack.Twin = frame.Message.TwinSrc
+
+	ctx, cancel := context.WithTimeout(context.Background(), link.timeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, linkPeer{}, link)
+	if link.relay {
+		ctx = context.WithValue(ctx, relayedDelivery{}, true)
+	}
+
+	ack.Status, ack.Error = a.deliver(ctx, frame.Type, frame.Message)
+	return ack
+}
+
+// serveLink handles the messages of an established link until it's closed
+func (a *App) serveLink(ctx context.Context, link *peerLink) {
+	a.links.add(link)
+	defer a.links.remove(link)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			link.close()
+		case <-link.closed:
+		}
+	}()
+
+	log.Info().Int("twin", link.twin).Msg("peer link established")
+	if a.relayMode {
+		go a.flushRelayed(ctx, link)
+	}
+	err := link.run(func(frame linkFrame) linkFrame {
+		return a.handleLinkFrame(link, frame)
+	})
+	log.Info().Err(err).Int("twin", link.twin).Msg("peer link closed")
+}
+
+var linkUpgrader = websocket.Upgrader{
+	HandshakeTimeout: linkHandshakeTimeout,
+	// the links are not opened by browsers
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// link accepts the links opened by other twins
+func (a *App) link(w http.ResponseWriter, r *http.Request) {
+	conn, err := linkUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied
+		return
+	}
+
+	twin, err := a.acceptLink(conn)
+	if err != nil {
+		log.Debug().Err(err).Str("remote", r.RemoteAddr).Msg("refused peer link")
+		conn.SetWriteDeadline(time.Now().Add(linkHandshakeTimeout))
+		conn.WriteJSON(linkFrame{Type: linkError, Error: err.Error()})
+		conn.Close()
+		return
+	}
+
+	a.serveLink(r.Context(), newPeerLink(twin, conn, a.transport.RequestTimeout))
+}
+
+// acceptLink runs the server side of the link handshake and returns the twin
+// that opened the link
+func (a *App) acceptLink(conn *websocket.Conn) (int, error) {
+	conn.SetReadDeadline(time.Now().Add(linkHandshakeTimeout))
+	conn.SetWriteDeadline(time.Now().Add(linkHandshakeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	var hello linkFrame
+	if err := conn.ReadJSON(&hello); err != nil {
+		return 0, err
+	}
+	if hello.Type != linkHello || hello.Twin <= 0 || len(hello.Nonce) != linkNonceSize {
+		return 0, fmt.Errorf("invalid link hello")
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return 0, err
+	}
+	signature, err := signPayload(a.identity, linkPayload(linkServerDomain, hello.Twin, a.twin, hello.Nonce, nonce))
+	if err != nil {
+		return 0, err
+	}
+	if err := conn.WriteJSON(linkFrame{Type: linkChallenge, Twin: a.twin, Nonce: nonce, Signature: signature}); err != nil {
+		return 0, err
+	}
+
+	var auth linkFrame
+	if err := conn.ReadJSON(&auth); err != nil {
+		return 0, err
+	}
+	if auth.Type != linkAuth {
+		return 0, fmt.Errorf("invalid link auth")
+	}
+	pk, keyType, err := a.twinKey(hello.Twin)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't get twin %d public key", hello.Twin)
+	}
+	if err := verifyPayload(pk, keyType, linkPayload(linkClientDomain, hello.Twin, a.twin, hello.Nonce, nonce), auth.Signature); err != nil {
+		return 0, errors.Wrapf(err, "link is not signed by twin %d", hello.Twin)
+	}
+
+	return hello.Twin, conn.WriteJSON(linkFrame{Type: linkReady})
+}
+
+// dialLink opens a link to the peer at url and runs the client side of the
+// handshake
+func (a *App) dialLink(ctx context.Context, url string, relay bool) (*peerLink, error) {
+	ctx, cancel := context.WithTimeout(ctx, linkHandshakeTimeout)
+	defer cancel()
+
+	conn, _, err := a.websocketDialer().DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	twin, err := a.openLink(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	link := newPeerLink(twin, conn, a.transport.RequestTimeout)
+	link.relay = relay
+	return link, nil
+}
+
+// openLink runs the client side of the link handshake and returns the twin of
+// the peer
+func (a *App) openLink(conn *websocket.Conn) (int, error) {
+	conn.SetReadDeadline(time.Now().Add(linkHandshakeTimeout))
+	conn.SetWriteDeadline(time.Now().Add(linkHandshakeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	nonce, err := newNonce()
+	if err != nil {
+		return 0, err
+	}
+	if err := conn.WriteJSON(linkFrame{Type: linkHello, Twin: a.twin, Nonce: nonce}); err != nil {
+		return 0, err
+	}
+
+	var challenge linkFrame
+	if err := conn.ReadJSON(&challenge); err != nil {
+		return 0, err
+	}
+	if challenge.Type == linkError {
+		return 0, fmt.Errorf("peer refused the link: %s", challenge.Error)
+	}
+	if challenge.Type != linkChallenge || challenge.Twin <= 0 || len(challenge.Nonce) != linkNonceSize {
+		return 0, fmt.Errorf("invalid link challenge")
+	}
+	pk, keyType, err := a.twinKey(challenge.Twin)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't get twin %d public key", challenge.Twin)
+	}
+	if err := verifyPayload(pk, keyType, linkPayload(linkServerDomain, a.twin, challenge.Twin, nonce, challenge.Nonce), challenge.Signature); err != nil {
+		return 0, errors.Wrapf(err, "link is not signed by twin %d", challenge.Twin)
+	}
+
+	signature, err := signPayload(a.identity, linkPayload(linkClientDomain, a.twin, challenge.Twin, nonce, challenge.Nonce))
+	if err != nil {
+		return 0, err
+	}
+	if err := conn.WriteJSON(linkFrame{Type: linkAuth, Signature: signature}); err != nil {
+		return 0, err
+	}
+
+	var ready linkFrame
+	if err := conn.ReadJSON(&ready); err != nil {
+		return 0, err
+	}
+	if ready.Type != linkReady {
+		return 0, fmt.Errorf("peer refused the link: %s", ready.Error)
+	}
+	return challenge.Twin, nil
+}
+
+// keepLink keeps a link open to the peer at url, it's opened again with an
+// exponential backoff when it's closed. relay is set if the peer is the relay
+// of this twin.
+func (a *App) keepLink(ctx context.Context, url string, relay bool) {
+	backoff := linkBackoffMin
+	for {
+		link, err := a.dialLink(ctx, url, relay)
+		if err == nil {
+			backoff = linkBackoffMin
+			a.serveLink(ctx, link)
+		} else {
+			log.Warn().Err(err).Str("url", url).Msg("couldn't open peer link")
+		}
+
+		var ok bool
+		if backoff, ok = waitBackoff(ctx, backoff); !ok {
+			return
+		}
+	}
+}
+
+// waitBackoff waits a random delay up to backoff, so the twins behind a
+// restarted peer don't all come back at once. It returns the next backoff, or
+// false if ctx is done.
+func waitBackoff(ctx context.Context, backoff time.Duration) (time.Duration, bool) {
+	wait := backoff
+	if jitter, err := rand.Int(rand.Reader, big.NewInt(int64(backoff/2))); err == nil {
+		wait = backoff/2 + time.Duration(jitter.Int64())
+	}
+	select {
+	case <-ctx.Done():
+		return backoff, false
+	case <-time.After(wait):
+	}
+	if backoff *= 2; backoff > linkBackoffMax {
+		backoff = linkBackoffMax
+	}
+	return backoff, true
+}
@@ -0,0 +1,186 @@
+package rmb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/substrate-client"
+)
+
+func linkApp(identity substrate.Identity, twin int, keys testKeys) (*App, *BackendMock) {
+	backend := NewBackendMock()
+	return &App{
+		backend:   backend,
+		identity:  identity,
+		twin:      twin,
+		resolver:  keys,
+		clockSkew: DefaultClockSkew,
+		transport: DefaultTransportConfig(),
+		peers:     testTransport(DefaultTransportConfig()),
+		links:     newPeerLinks(),
+	}, backend
+}
+
+func linkMessage(t *testing.T, identity substrate.Identity, src, dst int) Message {
+	msg := Message{
+		Version:  1,
+		ID:       uuid.New().String(),
+		Command:  "griddb.twins.get",
+		TwinSrc:  src,
+		TwinDst:  []int{dst},
+		Retqueue: "caller",
+		Epoch:    time.Now().Unix(),
+	}
+	require.NoError(t, msg.Sign(identity))
+	return msg
+}
+
+// waitLink waits for the app to have a link to the twin
+func waitLink(t *testing.T, a *App, twin int) *peerLink {
+	for i := 0; i < 100; i++ {
+		if link, ok := a.links.get(twin); ok {
+			return link
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no link to twin %d", twin)
+	return nil
+}
+
+func TestPeerLink(t *testing.T) {
+	ed, sr, keys := testIdentities(t)
+	peer, peerBackend := linkApp(ed, 1, keys)
+	natted, nattedBackend := linkApp(sr, 2, keys)
+
+	server := httptest.NewServer(http.HandlerFunc(peer.link))
+	defer server.Close()
+	url, err := linkURL(server.URL)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go natted.keepLink(ctx, url, false)
+
+	// the peer reaches the twin behind NAT over the link, and the other way
+	waitLink(t, peer, 2)
+	toNatted, err := peer.resolve(2)
+	require.NoError(t, err)
+	require.IsType(t, &peerLink{}, toNatted)
+	require.NoError(t, toNatted.SendRemote(linkMessage(t, ed, 1, 2)))
+	require.Len(t, nattedBackend.remotes, 1)
+
+	toPeer := waitLink(t, natted, 1)
+	reply := linkMessage(t, sr, 2, 1)
+	require.NoError(t, toPeer.SendReply(reply))
+	require.Len(t, peerBackend.replies, 1)
+
+	// errors of the peer are acknowledged with their status
+	err = toPeer.SendReply(reply)
+	assert.Contains(t, err.Error(), "409")
+	assert.False(t, errors.Is(err, ErrTwinUnreachable))
+
+	// the twin can't send messages from other twins over its link
+	err = toPeer.SendRemote(linkMessage(t, ed, 1, 1))
+	assert.Contains(t, err.Error(), "403")
+
+	// the link is opened again when it's closed
+	toNatted.(*peerLink).close()
+	time.Sleep(50 * time.Millisecond)
+	relinked := waitLink(t, peer, 2)
+	assert.True(t, toNatted.(*peerLink) != relinked)
+	require.NoError(t, relinked.SendRemote(linkMessage(t, ed, 1, 2)))
+	require.Len(t, nattedBackend.remotes, 2)
+}
+
+func TestPeerLinkForged(t *testing.T) {
+	ed, sr, keys := testIdentities(t)
+	peer, _ := linkApp(ed, 1, keys)
+	// twin 2 identity with the key of another twin
+	forged, _ := linkApp(ed, 2, keys)
+
+	server := httptest.NewServer(http.HandlerFunc(peer.link))
+	defer server.Close()
+	url, err := linkURL(server.URL)
+	require.NoError(t, err)
+
+	_, err = forged.dialLink(context.Background(), url, false)
+	assert.Error(t, err)
+	_, ok := peer.links.get(2)
+	assert.False(t, ok)
+
+	// the peer must prove its twin too
+	impostor, _ := linkApp(sr, 2, keys)
+	fake, _ := linkApp(sr, 1, keys)
+	fakeServer := httptest.NewServer(http.HandlerFunc(fake.link))
+	defer fakeServer.Close()
+	url, err = linkURL(fakeServer.URL)
+	require.NoError(t, err)
+	_, err = impostor.dialLink(context.Background(), url, false)
+	assert.True(t, errors.Is(err, ErrPeerNotVerified))
+}
+
+func TestLinkURL(t *testing.T) {
+	cases := map[string]string{
+		"10.0.0.1":                 "ws://10.0.0.1:8051/zbus-link",
+		"https://peer.example.com": "wss://peer.example.com/zbus-link",
+		"ws://[200::1]:9000":       "ws://[200::1]:9000/zbus-link",
+	}
+	for address, expected := range cases {
+		url, err := linkURL(address)
+		require.NoError(t, err)
+		assert.Equal(t, expected, url)
+	}
+	_, err := linkURL("unix:///run/rmb.sock")
+	assert.Error(t, err)
+}
+
+// handshake runs the first steps of the client side of the handshake by hand,
+// and returns the challenge of the peer
+func handshake(t *testing.T, url string, twin int, nonce []byte) (*websocket.Conn, linkFrame) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteJSON(linkFrame{Type: linkHello, Twin: twin, Nonce: nonce}))
+	var challenge linkFrame
+	require.NoError(t, conn.ReadJSON(&challenge))
+	require.Equal(t, linkChallenge, challenge.Type)
+	return conn, challenge
+}
+
+func TestPeerLinkReflection(t *testing.T) {
+	ed, sr, keys := testIdentities(t)
+	target, _ := linkApp(ed, 1, keys)
+	victim, _ := linkApp(sr, 2, keys)
+
+	targetServer := httptest.NewServer(http.HandlerFunc(target.link))
+	defer targetServer.Close()
+	targetURL, err := linkURL(targetServer.URL)
+	require.NoError(t, err)
+	victimServer := httptest.NewServer(http.HandlerFunc(victim.link))
+	defer victimServer.Close()
+	victimURL, err := linkURL(victimServer.URL)
+	require.NoError(t, err)
+
+	// the attacker claims to be the victim to the target, and has the victim
+	// sign the challenge of the target as the server of another link
+	nonce, err := newNonce()
+	require.NoError(t, err)
+	toTarget, challenge := handshake(t, targetURL, 2, nonce)
+	defer toTarget.Close()
+	toVictim, reflected := handshake(t, victimURL, 1, challenge.Nonce)
+	defer toVictim.Close()
+
+	require.NoError(t, toTarget.WriteJSON(linkFrame{Type: linkAuth, Signature: reflected.Signature}))
+	var ready linkFrame
+	require.NoError(t, toTarget.ReadJSON(&ready))
+	assert.Equal(t, linkError, ready.Type)
+	_, ok := target.links.get(2)
+	assert.False(t, ok)
+}
@@ -2,15 +2,40 @@ package rmb
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"hash"
+	"io"
+	"net"
 	"net/http"
 	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	"github.com/threefoldtech/substrate-client"
 )
 
+const (
+	// ProtocolV1 is the legacy protocol, its challenge is an md5 digest of the
+	// concatenated message fields. It is still accepted during the migration window.
+	ProtocolV1 = 1
+	// ProtocolV2 challenge is a sha256 digest of all the length prefixed message fields
+	// (except the signature itself).
+	ProtocolV2 = 2
+)
+
+// DefaultClockSkew is the default accepted difference between a message
+// timestamp and the local time, in both directions.
+const DefaultClockSkew = 60 * time.Second
+
+// ErrFutureMessage is returned if a message timestamp is ahead of the local time
+// by more than the accepted clock skew.
+var ErrFutureMessage = fmt.Errorf("message timestamp is in the future, the sender clock is probably off")
+
 type Message struct {
 	Version    int    `json:"ver"`
 	ID         string `json:"uid"`
@@ -25,6 +50,7 @@ type Message struct {
 	Epoch      int64  `json:"now"`
 	Proxy      bool   `json:"pxy"`
 	Err        string `json:"err"`
+	Encrypted  bool   `json:"enc"`
 	Signature  string `json:"sig"`
 }
 
@@ -38,12 +64,210 @@ type ErrorReply struct {
 }
 
 type App struct {
-	backend  Backend
-	identity substrate.Identity
-	twin     int
-	resolver TwinResolver
-	server   *http.Server
-	workers  int
+	backend   Backend
+	identity  substrate.Identity
+	twin      int
+	resolver  TwinResolver
+	events    TwinEventSource
+	transport TransportConfig
+	peers     *peerTransport
+	// transports are the extra twin transports registered on peers
+	transports []schemeTransport
+	// links are the established peer links, linkURLs are the peers this
+	// server keeps a link open to
+	links    *peerLinks
+	linkURLs []string
+	// relayMode holds the messages of the twins registered on this server,
+	// relay is the relay this twin gets its own messages from
+	relayMode    bool
+	relayAddress string
+	relayPoll    time.Duration
+	relay        *relayClient
+	// gridRelay is the relay of the newer rmb this twin is connected to
+	gridRelayURL string
+	gridRelay    *gridRelay
+	breaker      BreakerConfig
+	breakers     *breakers
+	// certificate is the TLS certificate bound to the twin, serveTLS enables
+	// TLS on the server and requirePeer only accepts messages over mutual TLS
+	certificate tls.Certificate
+	serveTLS    bool
+	requirePeer bool
+	handshakes  *handshakeLimiter
+	server      *http.Server
+	listeners   []net.Listener
+	// quicAddress is the UDP address the peers are also served on over QUIC
+	quicAddress string
+	admin       *http.Server
+	workers     int
+	encrypt     bool
+	clockSkew   time.Duration
+	commands    CommandFilter
+	policy      *PolicyStore
+	limiter     *RateLimiter
+	// rekeys are the twins whose key was looked up again after an invalid
+	// signature, recently
+	rekeys *cache.Cache
+	// encrypted are the requests received encrypted, their replies are
+	// encrypted even if encryption is not enabled
+	encrypted *cache.Cache
+}
+
+// ServerOption configures optional features of the server
+type ServerOption func(*App)
+
+// WithEncryption enables end to end encryption of the messages data sent to
+// other twins (both requests and replies).
+func WithEncryption(enabled bool) ServerOption {
+	return func(a *App) {
+		a.encrypt = enabled
+	}
+}
+
+// WithClockSkew sets the accepted difference between the timestamp of received
+// messages and the local time.
+func WithClockSkew(skew time.Duration) ServerOption {
+	return func(a *App) {
+		a.clockSkew = skew
+	}
+}
+
+// WithCommandFilter sets which commands remote twins are allowed to call
+func WithCommandFilter(filter CommandFilter) ServerOption {
+	return func(a *App) {
+		a.commands = filter
+	}
+}
+
+// WithPolicy sets the access policy that decides which twins can call which commands
+func WithPolicy(policy *PolicyStore) ServerOption {
+	return func(a *App) {
+		a.policy = policy
+	}
+}
+
+// WithRateLimits limits the rate of messages accepted from remote twins
+func WithRateLimits(limits RateLimits) ServerOption {
+	return func(a *App) {
+		a.limiter = NewRateLimiter(limits)
+	}
+}
+
+// WithResolver sets the resolver used to find the other twins, instead of
+// resolving them from the chain.
+func WithResolver(resolver TwinResolver) ServerOption {
+	return func(a *App) {
+		a.resolver = resolver
+	}
+}
+
+// WithTwinEvents sets the source of the twins changes, the changed twins are
+// evicted from the resolver cache.
+func WithTwinEvents(source TwinEventSource) ServerOption {
+	return func(a *App) {
+		a.events = source
+	}
+}
+
+// WithTransport configures the http transport used to send messages to the
+// other twins
+func WithTransport(cfg TransportConfig) ServerOption {
+	return func(a *App) {
+		a.transport = cfg
+	}
+}
+
+// WithCircuitBreaker configures the circuit breaker of the destination twins
+func WithCircuitBreaker(cfg BreakerConfig) ServerOption {
+	return func(a *App) {
+		a.breaker = cfg
+	}
+}
+
+// WithTLS serves the other twins over TLS, with a certificate bound to the twin
+// identity. The twins must then publish an https address. If requirePeer is set
+// the messages from other twins are only accepted over mutual TLS, from the
+// twin of the peer certificate.
+func WithTLS(requirePeer bool) ServerOption {
+	return func(a *App) {
+		a.serveTLS = true
+		a.requirePeer = requirePeer
+	}
+}
+
+// WithTwinTransport sends the messages to the twin addresses with the given
+// schemes (e.g. `ws`) with transport, instead of the built-in transports (http,
+// https and unix).
+func WithTwinTransport(transport TwinTransport, schemes ...string) ServerOption {
+	return func(a *App) {
+		a.transports = append(a.transports, schemeTransport{transport: transport, schemes: schemes})
+	}
+}
+
+// WithPeerLink keeps a WebSocket link open to the peer rmb at address (e.g.
+// `https://peer.example.com` or `ws://10.0.0.2:8051`). The messages between this
+// twin and the peer go over the link both ways, so the peer can reach this twin
+// even if it's behind NAT.
+func WithPeerLink(address string) ServerOption {
+	return func(a *App) {
+		a.linkURLs = append(a.linkURLs, address)
+	}
+}
+
+// WithRelayMode makes the server a relay: it holds the messages sent to the
+// twins registered on it until they get them over a peer link or by polling.
+func WithRelayMode() ServerOption {
+	return func(a *App) {
+		a.relayMode = true
+	}
+}
+
+// WithRelay registers the twin on the relay at address so it gets the messages
+// held for it. The messages are polled every poll interval, or sent over a peer
+// link kept open to the relay if poll is 0. The twin address on the chain must
+// point to the relay (`relay://<relay address>`).
+func WithRelay(address string, poll time.Duration) ServerOption {
+	return func(a *App) {
+		a.relayAddress, a.relayPoll = address, poll
+	}
+}
+
+// WithGridRelay connects the twin to a relay of the newer rmb at url
+// (`wss://relay.example.com`), so it exchanges messages with the twins using
+// it. These twins have the url of their relay as address.
+func WithGridRelay(url string) ServerOption {
+	return func(a *App) {
+		a.gridRelayURL = url
+	}
+}
+
+// WithQUIC also serves the other twins over QUIC on the UDP address (e.g.
+// `:8051`). The twins reach this one over QUIC if its address on the chain
+// lists `quic://<host>:<port>`, usually before its http address which is used
+// by the peers that can't reach it over UDP.
+func WithQUIC(address string) ServerOption {
+	return func(a *App) {
+		a.quicAddress = address
+	}
+}
+
+// WithListener also serves the other twins on the listener, e.g. a unix socket
+// or an in-process listener (see InProcessTransport).
+func WithListener(l net.Listener) ServerOption {
+	return func(a *App) {
+		a.listeners = append(a.listeners, l)
+	}
+}
+
+// WithAdminListen enables the admin endpoints (rate limits counters, etc...) on
+// the given address. They should only be reachable by the node operator.
+func WithAdminListen(addr string) ServerOption {
+	return func(a *App) {
+		a.admin = &http.Server{
+			Handler: mux.NewRouter(),
+			Addr:    addr,
+		}
+	}
 }
 
 func (m *Message) Sign(s substrate.Identity) error {
@@ -64,14 +288,51 @@ func (m *Message) Sign(s substrate.Identity) error {
 	return nil
 }
 
+// ValidateEpoch validates the message timestamp with the default clock skew
 func (m *Message) ValidateEpoch() error {
-	if time.Since(time.Unix(m.Epoch, 0)) > 60*time.Second {
-		return fmt.Errorf("message is too old, sent since %s, sent time: %d, now: %d", time.Since(time.Unix(m.Epoch, 0)).String(), m.Epoch, time.Now().Unix())
+	return m.ValidateEpochSkew(DefaultClockSkew)
+}
+
+// ValidateEpochSkew makes sure the message timestamp is not older or ahead of
+// the local time by more than skew.
+func (m *Message) ValidateEpochSkew(skew time.Duration) error {
+	return m.validateEpoch(skew, skew)
+}
+
+// validateEpoch makes sure the message is not older than maxAge, or ahead of
+// the local time by more than skew
+func (m *Message) validateEpoch(maxAge, skew time.Duration) error {
+	sent := time.Unix(m.Epoch, 0)
+	if time.Since(sent) > maxAge {
+		return fmt.Errorf("message is too old, sent since %s, sent time: %d, now: %d", time.Since(sent).String(), m.Epoch, time.Now().Unix())
+	}
+	if time.Until(sent) > skew {
+		return errors.Wrapf(ErrFutureMessage, "sent time is %s ahead, sent time: %d, now: %d", time.Until(sent).String(), m.Epoch, time.Now().Unix())
 	}
 	return nil
 }
 
+// replayKey identifies a message for replay protection, on the decoded
+// signature so another encoding of the same signature has the same key
+func (m *Message) replayKey() string {
+	signature, err := hex.DecodeString(m.Signature)
+	if err != nil {
+		// the message signature was verified before
+		signature = []byte(m.Signature)
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d:%s:", m.TwinSrc, m.ID)
+	hash.Write(signature)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
 func (m *Message) Verify(publicKey []byte) error {
+	return m.verify(publicKey, "")
+}
+
+// verify verifies the signature, keyType is the key type of the source twin
+// if it's known
+func (m *Message) verify(publicKey []byte, keyType string) error {
 	if m.Signature == "" {
 		return errors.New("signature field is empty, visit the project github repo for instructions to update")
 	}
@@ -79,7 +340,7 @@ func (m *Message) Verify(publicKey []byte) error {
 	if err != nil {
 		return err
 	}
-	decoded, err := hex.DecodeString(m.Signature)
+	decoded, err := decodeSignature(m.Signature)
 	if err != nil {
 		return errors.Wrap(err, "couldn't decode signature")
 	}
@@ -87,7 +348,7 @@ func (m *Message) Verify(publicKey []byte) error {
 	if err != nil {
 		return err
 	}
-	verifier, err := constructVerifier(publicKey, signatureType)
+	verifier, err := constructVerifier(publicKey, signatureType, keyType)
 	if err != nil {
 		return err
 	}
@@ -98,6 +359,17 @@ func (m *Message) Verify(publicKey []byte) error {
 }
 
 func (m *Message) challenge() ([]byte, error) {
+	switch m.Version {
+	case ProtocolV1:
+		return m.challengeV1()
+	case ProtocolV2:
+		return m.challengeV2()
+	default:
+		return nil, fmt.Errorf("unsupported protocol version %d", m.Version)
+	}
+}
+
+func (m *Message) challengeV1() ([]byte, error) {
 	hash := md5.New()
 
 	if _, err := fmt.Fprintf(hash, "%d", m.Version); err != nil {
@@ -140,3 +412,53 @@ func (m *Message) challenge() ([]byte, error) {
 
 	return hash.Sum(nil), nil
 }
+
+// challengeWriter encodes fields in an unambiguous way, integers are written
+// as 8 bytes big endian and strings and lists are prefixed with their length.
+type challengeWriter struct {
+	hash.Hash
+}
+
+func (w challengeWriter) writeInt(v int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	w.Write(buf[:])
+}
+
+func (w challengeWriter) writeString(s string) {
+	w.writeInt(int64(len(s)))
+	io.WriteString(w, s)
+}
+
+func (w challengeWriter) writeBool(b bool) {
+	if b {
+		w.Write([]byte{1})
+	} else {
+		w.Write([]byte{0})
+	}
+}
+
+func (m *Message) challengeV2() ([]byte, error) {
+	w := challengeWriter{sha256.New()}
+
+	w.writeString("rmb.v2")
+	w.writeInt(int64(m.Version))
+	w.writeString(m.ID)
+	w.writeString(m.Command)
+	w.writeInt(m.Expiration)
+	w.writeInt(int64(m.Retry))
+	w.writeString(m.Data)
+	w.writeInt(int64(m.TwinSrc))
+	w.writeInt(int64(len(m.TwinDst)))
+	for _, dst := range m.TwinDst {
+		w.writeInt(int64(dst))
+	}
+	w.writeString(m.Retqueue)
+	w.writeString(m.Schema)
+	w.writeInt(m.Epoch)
+	w.writeBool(m.Proxy)
+	w.writeString(m.Err)
+	w.writeBool(m.Encrypted)
+
+	return w.Sum(nil), nil
+}
@@ -0,0 +1,334 @@
+package rmb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/substrate-client"
+)
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+
+	principalAny   = "*"
+	principalGroup = "group:"
+	principalFarm  = "farm:"
+)
+
+var (
+	// ErrAccessDenied is returned if the policy refuses a command from a twin
+	ErrAccessDenied = fmt.Errorf("access denied")
+)
+
+// Policy decides which source twins are allowed to call each command. It's loaded
+// from a json file like
+//
+//	{
+//	  "default": "allow",
+//	  "groups": {"admins": [1, 2]},
+//	  "rules": [
+//	    {"command": "zos.admin.*", "allow": ["group:admins", "farm:1"]},
+//	    {"command": "zos.*", "allow": ["*"], "deny": [7]}
+//	  ]
+//	}
+//
+// The first rule matching the command decides: the twin is refused if it matches
+// any of the deny principals, otherwise it's accepted only if it matches one of
+// the allow principals. Commands that don't match any rule use the default
+// action (allow if not set).
+//
+// A principal is a twin id, `*` for any twin, `group:<name>` for the twins of a
+// group, or `farm:<id>` for the farm owner twin and the twins of the farm nodes.
+type Policy struct {
+	Default string           `json:"default"`
+	Groups  map[string][]int `json:"groups"`
+	Rules   []PolicyRule     `json:"rules"`
+}
+
+// PolicyRule sets which twins can call the commands matching the Command pattern
+// (path.Match syntax)
+type PolicyRule struct {
+	Command string     `json:"command"`
+	Allow   Principals `json:"allow"`
+	Deny    Principals `json:"deny"`
+}
+
+// Principals is a list of principals, twin ids can be written as numbers
+type Principals []string
+
+// FarmMembership checks if a twin belongs to a farm
+type FarmMembership interface {
+	InFarm(twin, farm int) (bool, error)
+}
+
+func (p *Principals) UnmarshalJSON(data []byte) error {
+	var raw []interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+
+	principals := make(Principals, 0, len(raw))
+	for _, item := range raw {
+		switch item := item.(type) {
+		case json.Number:
+			principals = append(principals, item.String())
+		case string:
+			principals = append(principals, item)
+		default:
+			return fmt.Errorf("invalid principal '%v'", item)
+		}
+	}
+	*p = principals
+	return nil
+}
+
+// LoadPolicy loads and validates a policy file
+func LoadPolicy(file string) (Policy, error) {
+	var policy Policy
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return policy, errors.Wrap(err, "couldn't read policy file")
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, errors.Wrap(err, "couldn't parse policy file")
+	}
+
+	return policy, policy.Valid()
+}
+
+// Valid validates the policy
+func (p *Policy) Valid() error {
+	if p.Default != "" && p.Default != PolicyAllow && p.Default != PolicyDeny {
+		return fmt.Errorf("invalid default policy action '%s'", p.Default)
+	}
+
+	for _, rule := range p.Rules {
+		if _, err := path.Match(rule.Command, ""); err != nil {
+			return errors.Wrapf(err, "invalid command pattern '%s'", rule.Command)
+		}
+		for _, principal := range append(append(Principals{}, rule.Allow...), rule.Deny...) {
+			if err := p.validPrincipal(principal); err != nil {
+				return errors.Wrapf(err, "invalid principal for command '%s'", rule.Command)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) validPrincipal(principal string) error {
+	switch {
+	case principal == principalAny:
+		return nil
+	case strings.HasPrefix(principal, principalGroup):
+		group := strings.TrimPrefix(principal, principalGroup)
+		if _, ok := p.Groups[group]; !ok {
+			return fmt.Errorf("unknown group '%s'", group)
+		}
+		return nil
+	case strings.HasPrefix(principal, principalFarm):
+		_, err := strconv.Atoi(strings.TrimPrefix(principal, principalFarm))
+		return err
+	default:
+		_, err := strconv.Atoi(principal)
+		return err
+	}
+}
+
+// Check checks if twin is allowed to call cmd, farms can be nil if the policy
+// doesn't use farm principals.
+func (p *Policy) Check(cmd string, twin int, farms FarmMembership) error {
+	for _, rule := range p.Rules {
+		if ok, _ := path.Match(rule.Command, cmd); !ok {
+			continue
+		}
+
+		denied, err := p.matchAny(rule.Deny, twin, farms)
+		if err != nil {
+			return err
+		}
+		if denied {
+			return errors.Wrapf(ErrAccessDenied, "twin %d is not allowed to call '%s'", twin, cmd)
+		}
+
+		allowed, err := p.matchAny(rule.Allow, twin, farms)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return errors.Wrapf(ErrAccessDenied, "twin %d is not allowed to call '%s'", twin, cmd)
+		}
+		return nil
+	}
+
+	if p.Default == PolicyDeny {
+		return errors.Wrapf(ErrAccessDenied, "twin %d is not allowed to call '%s'", twin, cmd)
+	}
+	return nil
+}
+
+func (p *Policy) matchAny(principals Principals, twin int, farms FarmMembership) (bool, error) {
+	for _, principal := range principals {
+		ok, err := p.match(principal, twin, farms)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (p *Policy) match(principal string, twin int, farms FarmMembership) (bool, error) {
+	switch {
+	case principal == principalAny:
+		return true, nil
+	case strings.HasPrefix(principal, principalGroup):
+		for _, member := range p.Groups[strings.TrimPrefix(principal, principalGroup)] {
+			if member == twin {
+				return true, nil
+			}
+		}
+		return false, nil
+	case strings.HasPrefix(principal, principalFarm):
+		farm, err := strconv.Atoi(strings.TrimPrefix(principal, principalFarm))
+		if err != nil {
+			return false, err
+		}
+		if farms == nil {
+			return false, fmt.Errorf("farm membership is not available")
+		}
+		ok, err := farms.InFarm(twin, farm)
+		if err != nil {
+			return false, errors.Wrapf(err, "couldn't check if twin %d is in farm %d", twin, farm)
+		}
+		return ok, nil
+	default:
+		id, err := strconv.Atoi(principal)
+		if err != nil {
+			return false, err
+		}
+		return id == twin, nil
+	}
+}
+
+// PolicyStore holds the policy loaded from a file, the policy is reloaded
+// without a restart when the file changes.
+type PolicyStore struct {
+	file   string
+	m      sync.RWMutex
+	policy Policy
+	farms  FarmMembership
+}
+
+// NewPolicyStore loads the policy from file
+func NewPolicyStore(file string) (*PolicyStore, error) {
+	store := &PolicyStore{file: file}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload loads the policy file again. The current policy is kept if the file
+// is not valid.
+func (s *PolicyStore) Reload() error {
+	policy, err := LoadPolicy(s.file)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.policy = policy
+	return nil
+}
+
+// Watch reloads the policy each time the file changes, until ctx is canceled
+func (s *PolicyStore) Watch(ctx context.Context, interval time.Duration) {
+	watchFile(ctx, s.file, interval, s.Reload)
+}
+
+// Check checks if twin is allowed to call cmd with the current policy
+func (s *PolicyStore) Check(cmd string, twin int) error {
+	// the farm membership can take chain round trips, the policy is not
+	// locked meanwhile (a reload replaces it, it's never modified)
+	s.m.RLock()
+	policy, farms := s.policy, s.farms
+	s.m.RUnlock()
+	return policy.Check(cmd, twin, farms)
+}
+
+func (s *PolicyStore) setFarmMembership(farms FarmMembership) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.farms = farms
+}
+
+type substrateFarms struct {
+	client *substrate.Substrate
+	cache  *cache.Cache
+}
+
+// NewSubstrateFarmMembership checks farm membership on the chain, a twin is a member
+// of a farm if it owns the farm or if it's the twin of one of the farm nodes.
+func NewSubstrateFarmMembership(client *substrate.Substrate, expiration time.Duration) FarmMembership {
+	return &substrateFarms{
+		client: client,
+		cache:  cache.New(expiration, time.Minute),
+	}
+}
+
+func (f *substrateFarms) InFarm(twin, farm int) (bool, error) {
+	key := fmt.Sprintf("%d:%d", twin, farm)
+	if cached, ok := f.cache.Get(key); ok {
+		return cached.(bool), nil
+	}
+
+	member, err := f.inFarm(twin, farm)
+	if err != nil {
+		return false, err
+	}
+
+	f.cache.Set(key, member, cache.DefaultExpiration)
+	return member, nil
+}
+
+func (f *substrateFarms) inFarm(twin, farm int) (bool, error) {
+	info, err := f.client.GetFarm(uint32(farm))
+	if errors.Is(err, substrate.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if int(info.TwinID) == twin {
+		return true, nil
+	}
+
+	nodeID, err := f.client.GetNodeByTwinID(uint32(twin))
+	if errors.Is(err, substrate.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	node, err := f.client.GetNode(nodeID)
+	if err != nil {
+		return false, err
+	}
+
+	return int(node.FarmID) == farm, nil
+}
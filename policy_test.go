@@ -0,0 +1,145 @@
+package rmb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type farmsMock map[int][]int
+
+func (f farmsMock) InFarm(twin, farm int) (bool, error) {
+	for _, member := range f[farm] {
+		if member == twin {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+const testPolicy = `{
+	"default": "deny",
+	"groups": {"admins": [1, 2]},
+	"rules": [
+		{"command": "zos.admin.*", "allow": ["group:admins", "farm:10"]},
+		{"command": "zos.*", "allow": ["*"], "deny": [7]},
+		{"command": "griddb.twins.get", "allow": [3, "4"]}
+	]
+}`
+
+func writeFile(t *testing.T, file, content string) {
+	require.NoError(t, os.WriteFile(file, []byte(content), 0644))
+}
+
+func TestPolicyCheck(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.json")
+	writeFile(t, file, testPolicy)
+
+	policy, err := LoadPolicy(file)
+	require.NoError(t, err)
+	farms := farmsMock{10: {5}}
+
+	cases := []struct {
+		cmd     string
+		twin    int
+		allowed bool
+	}{
+		{"zos.admin.reboot", 1, true},
+		{"zos.admin.reboot", 5, true},
+		{"zos.admin.reboot", 6, false},
+		{"zos.statistics.get", 6, true},
+		{"zos.statistics.get", 7, false},
+		{"griddb.twins.get", 4, true},
+		{"griddb.twins.get", 5, false},
+		{"other.command", 1, false},
+	}
+	for _, c := range cases {
+		err := policy.Check(c.cmd, c.twin, farms)
+		if c.allowed {
+			assert.NoError(t, err, "%s from %d", c.cmd, c.twin)
+		} else {
+			assert.True(t, errors.Is(err, ErrAccessDenied), "%s from %d", c.cmd, c.twin)
+		}
+	}
+
+	// farm principals can't be checked without farm membership
+	assert.Error(t, policy.Check("zos.admin.reboot", 6, nil))
+}
+
+func TestPolicyInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.json")
+
+	writeFile(t, file, `{"rules": [{"command": "zos.*", "allow": ["group:unknown"]}]}`)
+	_, err := LoadPolicy(file)
+	assert.Error(t, err)
+
+	writeFile(t, file, `{"default": "maybe"}`)
+	_, err = LoadPolicy(file)
+	assert.Error(t, err)
+}
+
+func TestPolicyStoreReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.json")
+	writeFile(t, file, `{"default": "deny"}`)
+
+	store, err := NewPolicyStore(file)
+	require.NoError(t, err)
+	assert.Error(t, store.Check("zos.statistics.get", 1))
+
+	writeFile(t, file, `{"default": "allow"}`)
+	require.NoError(t, store.Reload())
+	assert.NoError(t, store.Check("zos.statistics.get", 1))
+
+	// invalid files keep the current policy
+	writeFile(t, file, `{"default": "maybe"}`)
+	assert.Error(t, store.Reload())
+	assert.NoError(t, store.Check("zos.statistics.get", 1))
+}
+
+// blockingFarms blocks the membership checks until released
+type blockingFarms struct {
+	checking chan struct{}
+	release  chan struct{}
+}
+
+func (f blockingFarms) InFarm(twin, farm int) (bool, error) {
+	f.checking <- struct{}{}
+	<-f.release
+	return true, nil
+}
+
+func TestPolicyStoreCheckUnlocked(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.json")
+	writeFile(t, file, testPolicy)
+
+	store, err := NewPolicyStore(file)
+	require.NoError(t, err)
+	farms := blockingFarms{checking: make(chan struct{}), release: make(chan struct{})}
+	store.setFarmMembership(farms)
+
+	checked := make(chan error)
+	go func() {
+		checked <- store.Check("zos.admin.reboot", 11)
+	}()
+	<-farms.checking
+
+	// the policy can be reloaded while a farm membership is checked
+	reloaded := make(chan error)
+	go func() {
+		reloaded <- store.Reload()
+	}()
+	select {
+	case err := <-reloaded:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("reload is blocked by the membership check")
+	}
+
+	close(farms.release)
+	assert.NoError(t, <-checked)
+}
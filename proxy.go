@@ -0,0 +1,382 @@
+package rmb
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProxyConfig routes the connections to the peers through a proxy
+type ProxyConfig struct {
+	// URL of the proxy, either `http://[user:pass@]host:port` (HTTP CONNECT),
+	// `socks5://[user:pass@]host:port` (host names resolved locally) or
+	// `socks5h://[user:pass@]host:port` (host names resolved by the proxy). No
+	// proxy is used if it's empty (the HTTP_PROXY environment variables are
+	// still honored then).
+	URL string
+	// Bypass lists the destinations that are dialed directly: IPs, CIDR ranges
+	// (e.g. `200::/7` for the planetary network), host names and domains
+	// (`.example.com` matches all its sub domains), or `*` for all of them.
+	Bypass []string
+}
+
+// Valid validates the proxy configuration
+func (c *ProxyConfig) Valid() error {
+	if c.URL == "" {
+		if len(c.Bypass) != 0 {
+			return fmt.Errorf("proxy bypass rules are set without a proxy")
+		}
+		return nil
+	}
+	_, err := newProxyDialer(nil, *c)
+	return err
+}
+
+// contextDialer opens the connections to the peers
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// proxyDialer dials the tcp connections through the proxy, unless their
+// destination is bypassed
+type proxyDialer struct {
+	direct contextDialer
+	proxy  *url.URL
+	bypass bypassRules
+}
+
+func newProxyDialer(direct contextDialer, cfg ProxyConfig) (*proxyDialer, error) {
+	proxy, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy url")
+	}
+	switch proxy.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s', expected http, socks5 or socks5h", proxy.Scheme)
+	}
+	if proxy.Hostname() == "" || proxy.Port() == "" {
+		return nil, fmt.Errorf("proxy url must have a host and a port")
+	}
+	bypass, err := parseBypassRules(cfg.Bypass)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyDialer{direct: direct, proxy: proxy, bypass: bypass}, nil
+}
+
+func (d *proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return d.direct.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if d.bypass.match(host) {
+		return d.direct.DialContext(ctx, network, address)
+	}
+
+	targets := []string{host}
+	if d.proxy.Scheme == "socks5" && net.ParseIP(host) == nil {
+		// socks5 resolves the host names locally, so the bypass rules apply to
+		// their addresses too, socks5h leaves them to the proxy
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't resolve %s", host)
+		}
+		var direct []string
+		targets = targets[:0]
+		for _, addr := range addrs {
+			if ip := addr.IP.String(); d.bypass.match(ip) {
+				direct = append(direct, ip)
+			} else {
+				targets = append(targets, ip)
+			}
+		}
+		if len(direct) != 0 {
+			return dialFirst(ctx, direct, func(ip string) (net.Conn, error) {
+				return d.direct.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			})
+		}
+	}
+	return dialFirst(ctx, targets, func(target string) (net.Conn, error) {
+		return d.tunnel(ctx, target, port)
+	})
+}
+
+// dialFirst dials the targets in order and returns the first connection
+func dialFirst(ctx context.Context, targets []string, dial func(target string) (net.Conn, error)) (net.Conn, error) {
+	var err error
+	for _, target := range targets {
+		var conn net.Conn
+		if conn, err = dial(target); err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+	}
+	return nil, err
+}
+
+// tunnel opens a tunnel to host:port through the proxy
+func (d *proxyDialer) tunnel(ctx context.Context, host, port string) (net.Conn, error) {
+	address := net.JoinHostPort(host, port)
+	conn, err := d.direct.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't connect to proxy")
+	}
+	// the handshake is limited by the dial context
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	tunnel := conn
+	if d.proxy.Scheme == "http" {
+		tunnel, err = d.connect(conn, address)
+	} else {
+		err = d.socks5(conn, host, port)
+	}
+	close(stop)
+	<-stopped
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errors.Wrapf(err, "proxy couldn't connect to %s", address)
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// connect opens a tunnel to address with an HTTP CONNECT request
+func (d *proxyDialer) connect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused the connection: %s", resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		// the peer already sent data, it must be read first
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// socks5 opens a tunnel to host:port with the SOCKS5 protocol (RFC 1928), with
+// the username/password authentication (RFC 1929) if the proxy url has a user
+func (d *proxyDialer) socks5(conn net.Conn, host, port string) error {
+	const (
+		version      = 0x05
+		authNone     = 0x00
+		authPassword = 0x02
+		cmdConnect   = 0x01
+		addrIPv4     = 0x01
+		addrDomain   = 0x03
+		addrIPv6     = 0x04
+	)
+
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port '%s'", port)
+	}
+
+	methods := []byte{authNone}
+	if d.proxy.User != nil {
+		methods = []byte{authPassword}
+	}
+	if _, err := conn.Write(append([]byte{version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != version {
+		return fmt.Errorf("invalid socks version %d", reply[0])
+	}
+	switch reply[1] {
+	case authNone:
+	case authPassword:
+		if d.proxy.User == nil {
+			return fmt.Errorf("socks proxy requires a user")
+		}
+		username := d.proxy.User.Username()
+		password, _ := d.proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("socks user or password is too long")
+		}
+		request := []byte{0x01, byte(len(username))}
+		request = append(request, username...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("socks authentication failed")
+		}
+	default:
+		return fmt.Errorf("socks proxy doesn't accept the authentication methods")
+	}
+
+	request := []byte{version, cmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name is too long")
+		}
+		request = append(request, addrDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, addrIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, addrIPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, byte(portNumber>>8), byte(portNumber))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("socks proxy refused the connection (code %d)", header[1])
+	}
+	// skip the bound address
+	var skip int
+	switch header[3] {
+	case addrIPv4:
+		skip = net.IPv4len
+	case addrIPv6:
+		skip = net.IPv6len
+	case addrDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return err
+		}
+		skip = int(size[0])
+	default:
+		return fmt.Errorf("invalid socks address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// bypassRules are the destinations that don't go through the proxy
+type bypassRules struct {
+	all      bool
+	networks []*net.IPNet
+	hosts    []string
+	domains  []string
+}
+
+func parseBypassRules(rules []string) (bypassRules, error) {
+	var bypass bypassRules
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		switch {
+		case rule == "":
+		case rule == "*":
+			bypass.all = true
+		case strings.Contains(rule, "/"):
+			_, network, err := net.ParseCIDR(rule)
+			if err != nil {
+				return bypass, errors.Wrapf(err, "invalid proxy bypass range '%s'", rule)
+			}
+			bypass.networks = append(bypass.networks, network)
+		case net.ParseIP(rule) != nil:
+			ip := net.ParseIP(rule)
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			bypass.networks = append(bypass.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		case strings.HasPrefix(rule, "*."):
+			bypass.domains = append(bypass.domains, rule[1:])
+		case strings.HasPrefix(rule, "."):
+			bypass.domains = append(bypass.domains, rule)
+		default:
+			bypass.hosts = append(bypass.hosts, rule)
+		}
+	}
+	return bypass, nil
+}
+
+func (b *bypassRules) match(host string) bool {
+	if b.all {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range b.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, candidate := range b.hosts {
+		if host == candidate {
+			return true
+		}
+	}
+	for _, domain := range b.domains {
+		if strings.HasSuffix(host, domain) || host == domain[1:] {
+			return true
+		}
+	}
+	return false
+}
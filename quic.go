@@ -0,0 +1,375 @@
+package rmb
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+)
+
+// QUIC carries the messages between two rmb servers on a single connection,
+// each message on its own stream: the sender writes the message frame (see
+// linkFrame) and closes its side of the stream, the peer answers with the
+// acknowledgment holding the status the http endpoint would have returned.
+// Both sides present their twin certificate, like with mutual TLS. The
+// connections are resumed with 0-RTT, the messages sent in early data can be
+// replayed by the network but they are signed and checked for replays like any
+// other message. The twins publish a `quic://host:port` address, with their
+// http address after it for the peers that can't reach them over UDP.
+const (
+	quicProtocol = "rmb/1"
+
+	quicIdleTimeout = 2 * time.Minute
+	quicKeepAlive   = 30 * time.Second
+	// quicRetryAfter is how long an endpoint that couldn't be reached is
+	// skipped, the messages go to the next transport of the twin meanwhile
+	quicRetryAfter = time.Minute
+	// quicMaxFrameSize limits the size of a frame read from a stream
+	quicMaxFrameSize = 32 << 20
+	// quicSessions is the number of sessions kept per twin for resumption
+	quicSessions = 8
+
+	quicNoError        quic.ApplicationErrorCode = 0
+	quicRefused        quic.ApplicationErrorCode = 1
+	quicStreamCanceled quic.StreamErrorCode      = 1
+)
+
+// quicPeer is the context key set on the messages received over QUIC, it holds
+// the twin of the peer certificate
+type quicPeer struct{}
+
+// quicTLSConfig is the TLS configuration of the QUIC listener, unlike over
+// http the peers must present their twin certificate
+func (a *App) quicTLSConfig() *tls.Config {
+	cfg := a.serverTLSConfig()
+	cfg.MinVersion = tls.VersionTLS13
+	cfg.ClientAuth = tls.RequireAnyClientCert
+	cfg.NextProtos = []string{quicProtocol}
+	return cfg
+}
+
+// listenQUIC listens for the QUIC connections of the peers on the UDP address
+func (a *App) listenQUIC(address string) (*quic.EarlyListener, error) {
+	return quic.ListenAddrEarly(address, a.quicTLSConfig(), &quic.Config{
+		MaxIdleTimeout:  quicIdleTimeout,
+		KeepAlivePeriod: quicKeepAlive,
+		Allow0RTT:       true,
+	})
+}
+
+// serveQUIC accepts the connections of the peers until the context is done,
+// the listener and its connections are closed then
+func (a *App) serveQUIC(ctx context.Context, l *quic.EarlyListener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept(ctx)
+		if err != nil {
+			return err
+		}
+		go a.serveQUICConn(ctx, conn)
+	}
+}
+
+// serveQUICConn delivers the messages of the streams opened by the peer
+func (a *App) serveQUICConn(ctx context.Context, conn *quic.Conn) {
+	twin, err := quicPeerTwin(ctx, conn)
+	if err != nil {
+		log.Debug().Err(err).Str("peer", conn.RemoteAddr().String()).Msg("refused QUIC connection")
+		conn.CloseWithError(quicRefused, err.Error())
+		return
+	}
+
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		go a.handleQUICStream(twin, stream)
+	}
+}
+
+// quicPeerTwin returns the twin of the peer certificate, verified during the
+// handshake (or the handshake of the session the connection resumes)
+func quicPeerTwin(ctx context.Context, conn *quic.Conn) (int, error) {
+	state := conn.ConnectionState().TLS
+	if len(state.PeerCertificates) == 0 {
+		select {
+		case <-conn.HandshakeComplete():
+		case <-conn.Context().Done():
+			return 0, context.Cause(conn.Context())
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		state = conn.ConnectionState().TLS
+	}
+	if len(state.PeerCertificates) == 0 {
+		return 0, errors.Wrap(ErrPeerNotVerified, "peer has no certificate")
+	}
+
+	binding, ok, err := certificateBinding(state.PeerCertificates[0])
+	if err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, errors.Wrap(ErrPeerNotVerified, "certificate is not bound to a twin")
+	}
+	return binding.Twin, nil
+}
+
+// handleQUICStream delivers the message of the stream and writes back the
+// acknowledgment
+func (a *App) handleQUICStream(twin int, stream *quic.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(a.transport.RequestTimeout))
+
+	ack := a.receiveQUIC(twin, stream)
+	if err := json.NewEncoder(stream).Encode(ack); err != nil {
+		log.Debug().Err(err).Int("twin", twin).Str("uid", ack.UID).Msg("couldn't acknowledge QUIC message")
+	}
+}
+
+// receiveQUIC reads the message frame sent by twin and delivers it, it returns
+// the acknowledgment
+func (a *App) receiveQUIC(twin int, r io.Reader) linkFrame {
+	var frame linkFrame
+	if err := json.NewDecoder(io.LimitReader(r, quicMaxFrameSize)).Decode(&frame); err != nil {
+		return linkFrame{Type: linkAck, Status: http.StatusBadRequest, Error: "invalid frame"}
+	}
+	ack := linkFrame{Type: linkAck, UID: frame.UID, Kind: frame.Type}
+	if frame.Message == nil || (frame.Type != linkRemote && frame.Type != linkReply) {
+		ack.Status, ack.Error = http.StatusBadRequest, "invalid message"
+		return ack
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.transport.RequestTimeout)
+	defer cancel()
+	ack.Status, ack.Error = a.deliver(context.WithValue(ctx, quicPeer{}, twin), frame.Type, frame.Message)
+	return ack
+}
+
+// quicTransport sends the messages to the twins with a `quic://` address. It
+// keeps one connection open per twin endpoint, the messages sent at the same
+// time are multiplexed on it.
+type quicTransport struct {
+	peers  *peerTransport
+	config *quic.Config
+	// proxied is set if the peers are reached through a proxy, which can't
+	// carry the UDP datagrams
+	proxied bool
+
+	m     sync.Mutex
+	conns map[string]*quic.Conn
+	// configs are the TLS configurations of the twins, each one with its
+	// sessions so the connections to the twin are resumed with 0-RTT
+	configs *cache.Cache
+	// down are the endpoints that couldn't be reached recently
+	down *cache.Cache
+}
+
+func newQUICTransport(peers *peerTransport, cfg TransportConfig) *quicTransport {
+	return &quicTransport{
+		peers: peers,
+		config: &quic.Config{
+			HandshakeIdleTimeout: cfg.DialTimeout,
+			MaxIdleTimeout:       quicIdleTimeout,
+			KeepAlivePeriod:      quicKeepAlive,
+		},
+		proxied: cfg.Proxy.URL != "",
+		conns:   make(map[string]*quic.Conn),
+		configs: cache.New(time.Hour, 10*time.Minute),
+		down:    cache.New(quicRetryAfter, time.Minute),
+	}
+}
+
+func (t *quicTransport) NewClient(twin int, endpoints []string) (TwinClient, error) {
+	client := &quicClient{transport: t, twin: twin}
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Hostname() == "" || u.Path != "" {
+			return nil, fmt.Errorf("invalid quic address '%s', expected quic://host:port", endpoint)
+		}
+		port := u.Port()
+		if port == "" {
+			port = strconv.Itoa(defaultPort)
+		}
+		client.addresses = append(client.addresses, net.JoinHostPort(u.Hostname(), port))
+	}
+	return client, nil
+}
+
+// tlsConfig returns the TLS configuration used to connect to twin, it must be
+// called with the lock held
+func (t *quicTransport) tlsConfig(twin int) (*tls.Config, error) {
+	if t.peers.certificate == nil {
+		return nil, fmt.Errorf("no twin certificate to connect over QUIC")
+	}
+
+	key := fmt.Sprint(twin)
+	if cfg, ok := t.configs.Get(key); ok {
+		return cfg.(*tls.Config), nil
+	}
+	// the QUIC peers are reached directly, they must present their twin
+	// certificate
+	cfg := clientTLSConfig(twin, t.peers.certificate, t.peers.twinKey, false)
+	cfg.MinVersion = tls.VersionTLS13
+	cfg.NextProtos = []string{quicProtocol}
+	cfg.ClientSessionCache = tls.NewLRUClientSessionCache(quicSessions)
+	t.configs.Set(key, cfg, cache.DefaultExpiration)
+	return cfg, nil
+}
+
+func quicConnKey(twin int, address string) string {
+	return fmt.Sprintf("%d/%s", twin, address)
+}
+
+// conn returns the open connection to the twin endpoint, or dials a new one.
+// The data is sent in 0-RTT if the twin was connected to before.
+func (t *quicTransport) conn(ctx context.Context, twin int, address string) (*quic.Conn, error) {
+	key := quicConnKey(twin, address)
+	t.m.Lock()
+	if conn, ok := t.conns[key]; ok && conn.Context().Err() == nil {
+		t.m.Unlock()
+		return conn, nil
+	}
+	if _, ok := t.down.Get(address); ok {
+		t.m.Unlock()
+		return nil, fmt.Errorf("%s was not reachable over QUIC recently", address)
+	}
+	cfg, err := t.tlsConfig(twin)
+	t.m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := quic.DialAddrEarly(ctx, address, cfg, t.config)
+	if err != nil {
+		t.down.Set(address, true, cache.DefaultExpiration)
+		return nil, err
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	// another message could have connected meanwhile
+	if current, ok := t.conns[key]; ok && current.Context().Err() == nil {
+		conn.CloseWithError(quicNoError, "")
+		return current, nil
+	}
+	t.conns[key] = conn
+	return conn, nil
+}
+
+// forget closes the connection to the twin endpoint, the next message dials a
+// new one
+func (t *quicTransport) forget(twin int, address string, conn *quic.Conn) {
+	key := quicConnKey(twin, address)
+	t.m.Lock()
+	if t.conns[key] == conn {
+		delete(t.conns, key)
+	}
+	t.m.Unlock()
+	conn.CloseWithError(quicNoError, "")
+}
+
+// quicClient sends the messages of a twin over QUIC, the endpoints are tried
+// in order
+type quicClient struct {
+	transport *quicTransport
+	twin      int
+	addresses []string
+}
+
+func (c *quicClient) send(kind string, msg Message) error {
+	if c.transport.proxied {
+		return unreachableError{fmt.Errorf("twin %d can't be reached over QUIC through a proxy", c.twin)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.transport.peers.timeout)
+	defer cancel()
+
+	var lastErr error
+	for _, address := range c.addresses {
+		reached, err := c.sendTo(ctx, address, kind, msg)
+		if err == nil || reached {
+			return err
+		}
+
+		log.Debug().Err(err).Int("twin", c.twin).Str("endpoint", address).Msg("twin endpoint is not reachable over QUIC")
+		lastErr = err
+	}
+
+	return unreachableError{errors.Wrapf(lastErr, "twin %d is not reachable over QUIC", c.twin)}
+}
+
+// sendTo sends the message to the twin endpoint, reached is true if the twin
+// acknowledged the message even with an error
+func (c *quicClient) sendTo(ctx context.Context, address string, kind string, msg Message) (reached bool, err error) {
+	conn, err := c.transport.conn(ctx, c.twin, address)
+	if err != nil {
+		return false, err
+	}
+
+	reached, err = c.exchange(ctx, conn, kind, msg)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// the twin didn't accept the early data (e.g. it was restarted), the
+		// message is sent again once the handshake is done
+		var next *quic.Conn
+		if next, err = conn.NextConnection(ctx); err == nil {
+			reached, err = c.exchange(ctx, next, kind, msg)
+		}
+	}
+	if err != nil && !reached {
+		c.transport.forget(c.twin, address, conn)
+	}
+	return reached, err
+}
+
+// exchange sends the message on a new stream and reads the acknowledgment
+func (c *quicClient) exchange(ctx context.Context, conn *quic.Conn, kind string, msg Message) (reached bool, err error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return false, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(stream).Encode(linkFrame{Type: kind, UID: msg.ID, Message: &msg}); err != nil {
+		stream.CancelRead(quicStreamCanceled)
+		stream.CancelWrite(quicStreamCanceled)
+		return false, err
+	}
+	stream.Close()
+
+	var ack linkFrame
+	if err := json.NewDecoder(io.LimitReader(stream, quicMaxFrameSize)).Decode(&ack); err != nil {
+		stream.CancelRead(quicStreamCanceled)
+		return false, err
+	}
+	if ack.Status != http.StatusOK {
+		return true, ackError{status: ack.Status, message: ack.Error}
+	}
+	return true, nil
+}
+
+func (c *quicClient) SendRemote(msg Message) error {
+	return c.send(linkRemote, msg)
+}
+
+func (c *quicClient) SendReply(msg Message) error {
+	return c.send(linkReply, msg)
+}
@@ -0,0 +1,153 @@
+package rmb
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBackend locks the backend used by the QUIC server goroutines, the race
+// detector doesn't see the synchronization of the UDP exchanges with the test
+type syncBackend struct {
+	*BackendMock
+	m sync.Mutex
+}
+
+func (b *syncBackend) MarkSeen(ctx context.Context, key string, ttl time.Duration) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.BackendMock.MarkSeen(ctx, key, ttl)
+}
+
+func (b *syncBackend) QueueRemote(ctx context.Context, msg Message) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.BackendMock.QueueRemote(ctx, msg)
+}
+
+func (b *syncBackend) QueueReply(ctx context.Context, msg Message) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.BackendMock.QueueReply(ctx, msg)
+}
+
+// received returns the remote and reply messages queued so far
+func (b *syncBackend) received() (remotes []Message, replies []Message) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return append(remotes, b.remotes...), append(replies, b.replies...)
+}
+
+// quicApp is twin 1 with a backend safe for the QUIC server goroutines
+func quicApp(t *testing.T) (*App, *syncBackend) {
+	ed, _, keys := testIdentities(t)
+	app, mock := linkApp(ed, 1, keys)
+	backend := &syncBackend{BackendMock: mock}
+	app.backend = backend
+	return app, backend
+}
+
+// quicServer serves the app over QUIC on a local port, it returns its address
+func quicServer(t *testing.T, app *App) string {
+	var err error
+	app.certificate, err = newTwinCertificate(app.identity, app.twin)
+	require.NoError(t, err)
+	l, err := app.listenQUIC("127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go app.serveQUIC(ctx, l)
+	return "quic://" + l.Addr().String()
+}
+
+// quicPeers returns the peer transport of twin 2 and its QUIC transport
+func quicPeers(t *testing.T, cfg TransportConfig) (*peerTransport, *quicTransport) {
+	_, sr, keys := testIdentities(t)
+	cert, err := newTwinCertificate(sr, 2)
+	require.NoError(t, err)
+	peers := testTransport(cfg)
+	peers.setIdentity(&cert, keys.twinKey)
+	return peers, peers.registry.schemes["quic"].transport.(*quicTransport)
+}
+
+func TestQUICTransport(t *testing.T) {
+	ed, sr, _ := testIdentities(t)
+	app, backend := quicApp(t)
+	address := quicServer(t, app)
+	peers, transport := quicPeers(t, DefaultTransportConfig())
+
+	client, err := peers.registry.newClient(1, []string{address})
+	require.NoError(t, err)
+	require.IsType(t, &quicClient{}, client)
+
+	// the messages share the connection
+	for i := 0; i < 3; i++ {
+		require.NoError(t, client.SendRemote(linkMessage(t, sr, 2, 1)))
+	}
+	remotes, _ := backend.received()
+	require.Len(t, remotes, 3)
+	assert.Equal(t, 2, remotes[0].TwinSrc)
+	require.Len(t, transport.conns, 1)
+
+	// the next connection is resumed with 0-RTT
+	endpoint := strings.TrimPrefix(address, "quic://")
+	transport.forget(2, endpoint, transport.conns[quicConnKey(1, endpoint)])
+	require.NoError(t, client.SendReply(linkMessage(t, sr, 2, 1)))
+	_, replies := backend.received()
+	require.Len(t, replies, 1)
+	conn := transport.conns[quicConnKey(1, endpoint)]
+	require.NotNil(t, conn)
+	<-conn.HandshakeComplete()
+	assert.True(t, conn.ConnectionState().TLS.DidResume)
+	assert.True(t, conn.ConnectionState().Used0RTT)
+
+	// twin 2 can't send the messages of twin 1
+	err = client.SendRemote(linkMessage(t, ed, 1, 1))
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, ErrTwinUnreachable))
+	assert.Contains(t, err.Error(), "403")
+	remotes, _ = backend.received()
+	assert.Len(t, remotes, 3)
+}
+
+func TestQUICFallback(t *testing.T) {
+	ed, sr, keys := testIdentities(t)
+	app, backend := linkApp(ed, 1, keys)
+	server := httptest.NewServer(http.HandlerFunc(app.remote))
+	defer server.Close()
+
+	// a port nobody listens on
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := udp.LocalAddr().String()
+	udp.Close()
+
+	cfg := DefaultTransportConfig()
+	cfg.DialTimeout = 200 * time.Millisecond
+	peers, transport := quicPeers(t, cfg)
+	client, err := peers.registry.newClient(1, []string{"quic://" + closed, server.URL})
+	require.NoError(t, err)
+
+	require.NoError(t, client.SendRemote(linkMessage(t, sr, 2, 1)))
+	require.Len(t, backend.remotes, 1)
+	_, down := transport.down.Get(closed)
+	assert.True(t, down, "the endpoint is skipped for a while")
+
+	// QUIC can't go through a proxy
+	cfg.Proxy = ProxyConfig{URL: "socks5://127.0.0.1:1080"}
+	_, transport = quicPeers(t, cfg)
+	client, err = transport.NewClient(1, []string{"quic://127.0.0.1:8051"})
+	require.NoError(t, err)
+	err = client.SendRemote(linkMessage(t, sr, 2, 1))
+	assert.True(t, errors.Is(err, ErrTwinUnreachable))
+}
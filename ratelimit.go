@@ -0,0 +1,256 @@
+package rmb
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// buckets not used for that long are forgotten
+	rateLimitIdle = 10 * time.Minute
+	// rateLimitMaxBuckets caps the number of twin buckets and of command
+	// buckets, the least recently used one is dropped to make room
+	rateLimitMaxBuckets = 100000
+)
+
+// RateLimit configures a token bucket, Rate is the number of messages per second
+// and Burst the maximum number of messages accepted at once. A zero rate
+// disables the limit.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// TwinRateLimits are the limits applied to a source twin
+type TwinRateLimits struct {
+	// Twin limits all the messages of the source twin
+	Twin RateLimit `json:"twin"`
+	// Command limits the messages of the source twin to each single command
+	Command RateLimit `json:"command"`
+}
+
+// RateLimits configures the rate limits of the messages received from remote
+// twins. The default limits can be overridden for specific twins.
+//
+//	{
+//	  "default": {"twin": {"rate": 10, "burst": 50}, "command": {"rate": 5, "burst": 20}},
+//	  "twins": {"7": {"twin": {"rate": 100, "burst": 500}}}
+//	}
+type RateLimits struct {
+	Default TwinRateLimits         `json:"default"`
+	Twins   map[int]TwinRateLimits `json:"twins"`
+}
+
+// LoadRateLimits loads the rate limits from a json file
+func LoadRateLimits(file string) (RateLimits, error) {
+	var limits RateLimits
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return limits, errors.Wrap(err, "couldn't read rate limits file")
+	}
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return limits, errors.Wrap(err, "couldn't parse rate limits file")
+	}
+	return limits, nil
+}
+
+func (r *RateLimits) forTwin(twin int) TwinRateLimits {
+	if limits, ok := r.Twins[twin]; ok {
+		return limits
+	}
+	return r.Default
+}
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	allowed uint64
+	limited uint64
+}
+
+// refill adds the tokens earned since the last use, and returns the time to wait
+// for the next token
+func (b *bucket) refill(limit RateLimit, now time.Time) time.Duration {
+	if limit.Rate <= 0 {
+		b.last = now
+		return 0
+	}
+	burst := math.Max(float64(limit.Burst), 1)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+func (b *bucket) take(limit RateLimit) {
+	if limit.Rate > 0 {
+		b.tokens--
+	}
+	b.allowed++
+}
+
+type commandKey struct {
+	twin    int
+	command string
+}
+
+// RateLimiter applies token bucket rate limits per source twin, and per source
+// twin and command.
+type RateLimiter struct {
+	limits   RateLimits
+	m        sync.Mutex
+	twins    map[int]*bucket
+	commands map[commandKey]*bucket
+	cleaned  time.Time
+	// maxBuckets caps the size of twins and commands
+	maxBuckets int
+}
+
+// RateLimitStats are the counters of a rate limit bucket
+type RateLimitStats struct {
+	Twin    int     `json:"twin"`
+	Command string  `json:"command,omitempty"`
+	Allowed uint64  `json:"allowed"`
+	Limited uint64  `json:"limited"`
+	Tokens  float64 `json:"tokens"`
+}
+
+// NewRateLimiter creates a rate limiter with the given limits
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits:     limits,
+		twins:      make(map[int]*bucket),
+		commands:   make(map[commandKey]*bucket),
+		cleaned:    time.Now(),
+		maxBuckets: rateLimitMaxBuckets,
+	}
+}
+
+// Allow checks if a message of cmd from twin can be accepted. If not, it returns
+// how long the twin should wait before retrying.
+func (l *RateLimiter) Allow(twin int, cmd string) (bool, time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := time.Now()
+	l.cleanup(now)
+
+	limits := l.limits.forTwin(twin)
+	twinBucket, ok := l.twins[twin]
+	if !ok {
+		if len(l.twins) >= l.maxBuckets {
+			l.evictTwin()
+		}
+		twinBucket = &bucket{}
+		l.twins[twin] = twinBucket
+	}
+	if wait := twinBucket.refill(limits.Twin, now); wait > 0 {
+		twinBucket.limited++
+		return false, wait
+	}
+
+	// the command buckets are only created for the messages the twin limit
+	// accepts, so a twin can't add them faster than its own rate
+	key := commandKey{twin, cmd}
+	cmdBucket, ok := l.commands[key]
+	if !ok {
+		if len(l.commands) >= l.maxBuckets {
+			l.evictCommand()
+		}
+		cmdBucket = &bucket{}
+		l.commands[key] = cmdBucket
+	}
+	if wait := cmdBucket.refill(limits.Command, now); wait > 0 {
+		twinBucket.limited++
+		cmdBucket.limited++
+		return false, wait
+	}
+
+	twinBucket.take(limits.Twin)
+	cmdBucket.take(limits.Command)
+	return true, 0
+}
+
+// evictTwin drops the least recently used twin bucket
+func (l *RateLimiter) evictTwin() {
+	var oldest *bucket
+	var twin int
+	for id, b := range l.twins {
+		if oldest == nil || b.last.Before(oldest.last) {
+			oldest, twin = b, id
+		}
+	}
+	delete(l.twins, twin)
+}
+
+// evictCommand drops the least recently used command bucket
+func (l *RateLimiter) evictCommand() {
+	var oldest *bucket
+	var key commandKey
+	for k, b := range l.commands {
+		if oldest == nil || b.last.Before(oldest.last) {
+			oldest, key = b, k
+		}
+	}
+	delete(l.commands, key)
+}
+
+// cleanup drops the buckets that were not used for a while, they are full by now
+func (l *RateLimiter) cleanup(now time.Time) {
+	if now.Sub(l.cleaned) < time.Minute {
+		return
+	}
+	l.cleaned = now
+
+	for twin, b := range l.twins {
+		if now.Sub(b.last) > rateLimitIdle {
+			delete(l.twins, twin)
+		}
+	}
+	for key, b := range l.commands {
+		if now.Sub(b.last) > rateLimitIdle {
+			delete(l.commands, key)
+		}
+	}
+}
+
+// Stats returns the counters of all the twins and commands buckets
+func (l *RateLimiter) Stats() []RateLimitStats {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	stats := make([]RateLimitStats, 0, len(l.twins)+len(l.commands))
+	for twin, b := range l.twins {
+		stats = append(stats, RateLimitStats{Twin: twin, Allowed: b.allowed, Limited: b.limited, Tokens: b.tokens})
+	}
+	for key, b := range l.commands {
+		stats = append(stats, RateLimitStats{Twin: key.twin, Command: key.command, Allowed: b.allowed, Limited: b.limited, Tokens: b.tokens})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Twin != stats[j].Twin {
+			return stats[i].Twin < stats[j].Twin
+		}
+		return stats[i].Command < stats[j].Command
+	})
+	return stats
+}
+
+// retryAfter formats a wait duration for the Retry-After header (in seconds)
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,61 @@
+package rmb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(RateLimits{
+		Default: TwinRateLimits{
+			Twin:    RateLimit{Rate: 1, Burst: 3},
+			Command: RateLimit{Rate: 1, Burst: 2},
+		},
+		Twins: map[int]TwinRateLimits{
+			7: {},
+		},
+	})
+
+	ok, _ := limiter.Allow(1, "zos.statistics.get")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow(1, "zos.statistics.get")
+	assert.True(t, ok)
+	// command bucket is empty
+	ok, wait := limiter.Allow(1, "zos.statistics.get")
+	assert.False(t, ok)
+	assert.True(t, wait > 0)
+	// twin bucket still has one token
+	ok, _ = limiter.Allow(1, "griddb.twins.get")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow(1, "griddb.twins.get")
+	assert.False(t, ok)
+
+	// other twins have their own buckets, and twin 7 is not limited
+	ok, _ = limiter.Allow(2, "zos.statistics.get")
+	assert.True(t, ok)
+	for i := 0; i < 10; i++ {
+		ok, _ = limiter.Allow(7, "zos.statistics.get")
+		assert.True(t, ok)
+	}
+
+	stats := limiter.Stats()
+	assert.Equal(t, RateLimitStats{Twin: 1, Allowed: 3, Limited: 2, Tokens: stats[0].Tokens}, stats[0])
+}
+
+func TestRateLimiterMaxBuckets(t *testing.T) {
+	limiter := NewRateLimiter(RateLimits{
+		Default: TwinRateLimits{Command: RateLimit{Rate: 1, Burst: 1}},
+	})
+	limiter.maxBuckets = 2
+
+	for _, cmd := range []string{"a", "b", "c", "d"} {
+		ok, _ := limiter.Allow(1, cmd)
+		assert.True(t, ok)
+	}
+	assert.Len(t, limiter.commands, 2)
+	assert.Len(t, limiter.twins, 1)
+	// the most recent buckets are kept
+	ok, _ := limiter.Allow(1, "d")
+	assert.False(t, ok)
+}
@@ -0,0 +1,381 @@
+package rmb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/substrate-client"
+)
+
+// A relay holds the messages of the twins that can't be reached directly. The
+// twins register with a signed request, then get their messages from the relay
+// over a peer link or by polling it. The other twins find the relay of a twin
+// in its address (`relay://<relay address>`).
+const (
+	relayDomain       = "rmb.relay.v1"
+	relayRegisterPath = "/zbus-relay/register"
+	relayPollPath     = "/zbus-relay/poll"
+
+	relayRegistrationTTL  = 30 * time.Minute
+	relayRegisterInterval = 10 * time.Minute
+	relayRetryInterval    = 30 * time.Second
+	relayPollBatch        = 100
+
+	// defaultMessageExpiration is used for the messages without expiration,
+	// like the backlog does. It's also the longest a relay holds a message.
+	defaultMessageExpiration = 3600
+)
+
+// relayRequest is a request of a twin to its relay, signed by the twin. A poll
+// acknowledges the batch of messages the twin got from the previous one.
+type relayRequest struct {
+	Twin      int    `json:"twin"`
+	Epoch     int64  `json:"now"`
+	Ack       string `json:"ack,omitempty"`
+	Signature string `json:"sig"`
+}
+
+// relayBatch is the response to a poll, the messages are sent again until the
+// batch is acknowledged
+type relayBatch struct {
+	Batch    string     `json:"batch"`
+	Messages []Envelope `json:"messages"`
+}
+
+// relayPayload is what a twin signs for a relay request
+func relayPayload(action string, twin int, epoch int64, ack string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(relayDomain)
+	buf.WriteString(action)
+	var fields [16]byte
+	binary.BigEndian.PutUint64(fields[:8], uint64(twin))
+	binary.BigEndian.PutUint64(fields[8:], uint64(epoch))
+	buf.Write(fields[:])
+	buf.WriteString(ack)
+	return buf.Bytes()
+}
+
+func newRelayRequest(identity substrate.Identity, action string, twin int, ack string) (relayRequest, error) {
+	request := relayRequest{Twin: twin, Epoch: time.Now().Unix(), Ack: ack}
+	signature, err := signPayload(identity, relayPayload(action, twin, request.Epoch, ack))
+	if err != nil {
+		return request, errors.Wrap(err, "couldn't sign relay request")
+	}
+	request.Signature = signature
+	return request, nil
+}
+
+// expiresAt is the time after which the message can't be delivered anymore by
+// a relay, which holds the messages for defaultMessageExpiration at most
+func (m *Message) expiresAt() time.Time {
+	expiration := m.Expiration
+	if expiration == 0 || expiration > defaultMessageExpiration {
+		expiration = defaultMessageExpiration
+	}
+	return time.Unix(m.Epoch+expiration, 0)
+}
+
+// relayedDelivery is the context key set on the messages delivered by the
+// relay of this twin, they are accepted until they expire
+type relayedDelivery struct{}
+
+func isRelayedDelivery(ctx context.Context) bool {
+	relayed, _ := ctx.Value(relayedDelivery{}).(bool)
+	return relayed
+}
+
+func tagKind(tag Tag) string {
+	if tag == Reply {
+		return linkReply
+	}
+	return linkRemote
+}
+
+// relayMessage relays a message received for another twin registered on this
+// relay. handled is false if the message is not relayed, otherwise the status
+// and error are sent back to the sender.
+func (a *App) relayMessage(ctx context.Context, msg Message, tag Tag) (handled bool, status int, err error) {
+	if !a.relayMode || len(msg.TwinDst) != 1 || msg.TwinDst[0] == a.twin {
+		return false, 0, nil
+	}
+	dst := msg.TwinDst[0]
+
+	link, linked := a.links.get(dst)
+	if linked {
+		err := link.send(tagKind(tag), msg)
+		var ack ackError
+		if errors.As(err, &ack) {
+			return true, ack.status, fmt.Errorf("%s", ack.message)
+		} else if err == nil {
+			return true, http.StatusOK, nil
+		}
+		// the link is down, the message waits for the twin
+		log.Debug().Err(err).Int("twin", dst).Msg("couldn't relay message over link")
+	} else {
+		registered, err := a.backend.IsRelayed(ctx, dst)
+		if err != nil {
+			return true, http.StatusInternalServerError, err
+		}
+		if !registered {
+			return true, http.StatusNotFound, fmt.Errorf("twin %d is not registered on this relay", dst)
+		}
+	}
+
+	err = a.backend.PushRelayed(ctx, dst, Envelope{Message: msg, Tag: tag}, msg.expiresAt())
+	if errors.Is(err, ErrRelayFull) {
+		return true, http.StatusInsufficientStorage, err
+	} else if err != nil {
+		return true, http.StatusInternalServerError, errors.Wrap(err, "couldn't hold message")
+	}
+	log.Debug().Str("id", msg.ID).Int("src", msg.TwinSrc).Int("dst", dst).Msg("holding relayed message")
+	return true, http.StatusOK, nil
+}
+
+// flushRelayed sends the messages held for the twin of a new link
+func (a *App) flushRelayed(ctx context.Context, link *peerLink) {
+	for {
+		batch, envelopes, err := a.backend.NextRelayed(ctx, link.twin, relayPollBatch)
+		if err != nil {
+			log.Error().Err(err).Int("twin", link.twin).Msg("couldn't read relayed messages")
+			return
+		} else if batch == "" {
+			return
+		}
+		for _, envelope := range envelopes {
+			err := link.send(tagKind(envelope.Tag), envelope.Message)
+			if errors.Is(err, ErrTwinUnreachable) {
+				// the link is gone, the batch is sent again on the next one.
+				// The messages already delivered are refused as replays.
+				return
+			} else if err != nil {
+				log.Debug().Err(err).Str("id", envelope.ID).Int("twin", link.twin).Msg("relayed message refused")
+			}
+		}
+		if err := a.backend.AckRelayed(ctx, link.twin, batch); err != nil {
+			log.Error().Err(err).Int("twin", link.twin).Msg("couldn't acknowledge relayed messages")
+			return
+		}
+	}
+}
+
+// verifyRelayRequest checks the signature and time of a relay request, and
+// returns it with the twin that sent it
+func (a *App) verifyRelayRequest(r *http.Request, action string) (relayRequest, int, error) {
+	var request relayRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return request, http.StatusBadRequest, fmt.Errorf("couldn't parse json")
+	}
+	sent := time.Unix(request.Epoch, 0)
+	if time.Since(sent) > a.clockSkew || time.Until(sent) > a.clockSkew {
+		return request, http.StatusBadRequest, fmt.Errorf("relay request time is not within %s of the relay time", a.clockSkew)
+	}
+	pk, keyType, err := a.twinKey(request.Twin)
+	if errors.Is(err, substrate.ErrNotFound) {
+		return request, http.StatusBadRequest, fmt.Errorf("twin %d not found", request.Twin)
+	} else if err != nil {
+		return request, http.StatusBadGateway, fmt.Errorf("couldn't get twin %d public key: %s", request.Twin, err.Error())
+	}
+	if err := verifyPayload(pk, keyType, relayPayload(action, request.Twin, request.Epoch, request.Ack), request.Signature); err != nil {
+		return request, http.StatusForbidden, err
+	}
+	// a replayed poll would take the twin messages
+	key := fmt.Sprintf("relay.%s.%d.%s", action, request.Twin, request.Signature)
+	if err := a.backend.MarkSeen(r.Context(), key, 2*a.clockSkew); errors.Is(err, ErrReplayedMessage) {
+		return request, http.StatusConflict, err
+	} else if err != nil {
+		return request, http.StatusInternalServerError, err
+	}
+	return request, http.StatusOK, nil
+}
+
+// registerRelayed registers a twin on this relay
+func (a *App) registerRelayed(w http.ResponseWriter, r *http.Request) {
+	request, status, err := a.verifyRelayRequest(r, "register")
+	if err != nil {
+		errorReply(w, status, "%s", err.Error())
+		return
+	}
+	if err := a.backend.RegisterRelayed(r.Context(), request.Twin, relayRegistrationTTL); err != nil {
+		errorReply(w, http.StatusInternalServerError, "couldn't register twin")
+		return
+	}
+	log.Debug().Int("twin", request.Twin).Msg("twin registered on relay")
+	successReply(w)
+}
+
+// pollRelayed returns a batch of the messages held for a twin, they are removed
+// from the relay once the twin acknowledges the batch in its next poll
+func (a *App) pollRelayed(w http.ResponseWriter, r *http.Request) {
+	request, status, err := a.verifyRelayRequest(r, "poll")
+	if err != nil {
+		errorReply(w, status, "%s", err.Error())
+		return
+	}
+	if request.Ack != "" {
+		if err := a.backend.AckRelayed(r.Context(), request.Twin, request.Ack); err != nil {
+			errorReply(w, http.StatusInternalServerError, "couldn't acknowledge relayed messages")
+			return
+		}
+	}
+	batch, envelopes, err := a.backend.NextRelayed(r.Context(), request.Twin, relayPollBatch)
+	if err != nil {
+		errorReply(w, http.StatusInternalServerError, "couldn't read relayed messages")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(relayBatch{Batch: batch, Messages: envelopes}); err != nil {
+		log.Error().Err(err).Msg("failed to encode relayed messages")
+	}
+}
+
+// relayClient is the relay this twin gets its messages from
+type relayClient struct {
+	base    string
+	linkURL string
+	poll    time.Duration
+	// ack is the last batch delivered, it's acknowledged by the next poll
+	ack string
+}
+
+func newRelayClient(address string, poll time.Duration) (*relayClient, error) {
+	base, err := parseTwinAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if scheme := endpointScheme(base); scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("relay address '%s' must be a http url", address)
+	}
+	url, err := linkURL(base)
+	if err != nil {
+		return nil, err
+	}
+	return &relayClient{base: base, linkURL: url, poll: poll}, nil
+}
+
+// postRelay sends a signed relay request to the relay and decodes its response in
+// result if it's not nil
+func (a *App) postRelay(ctx context.Context, path, action, ack string, result interface{}) error {
+	request, err := newRelayRequest(a.identity, action, a.twin, ack)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.peers.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.relay.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.peers.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("relay refused the request: %s (%s)", resp.Status, readError(resp.Body))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// pollRelay delivers the messages held by the relay for this twin, each poll
+// acknowledges the batch delivered from the previous one. It polls until the
+// relay has no more messages, so the last batch is acknowledged too.
+func (a *App) pollRelay(ctx context.Context) error {
+	for {
+		var batch relayBatch
+		if err := a.postRelay(ctx, relayPollPath, "poll", a.relay.ack, &batch); err != nil {
+			return errors.Wrap(err, "couldn't poll relay")
+		}
+		delivery := context.WithValue(ctx, relayedDelivery{}, true)
+		for _, envelope := range batch.Messages {
+			msg := envelope.Message
+			if status, reason := a.deliver(delivery, tagKind(envelope.Tag), &msg); status != http.StatusOK {
+				log.Warn().Str("id", msg.ID).Int("src", msg.TwinSrc).Int("status", status).Str("error", reason).Msg("refused relayed message")
+			}
+		}
+		a.relay.ack = batch.Batch
+		if batch.Batch == "" {
+			return nil
+		}
+	}
+}
+
+// keepRelay keeps this twin registered on its relay, and gets the messages
+// held for it over a link or by polling
+func (a *App) keepRelay(ctx context.Context) {
+	if a.relay.poll == 0 {
+		go a.keepLink(ctx, a.relay.linkURL, true)
+	}
+
+	interval := relayRetryInterval
+	if a.relay.poll != 0 {
+		interval = a.relay.poll
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var registered time.Time
+	for {
+		if time.Since(registered) > relayRegisterInterval {
+			if err := a.postRelay(ctx, relayRegisterPath, "register", "", nil); err != nil {
+				log.Warn().Err(err).Str("relay", a.relay.base).Msg("couldn't register on relay")
+			} else {
+				registered = time.Now()
+			}
+		}
+		if a.relay.poll != 0 {
+			if err := a.pollRelay(ctx); err != nil {
+				log.Warn().Err(err).Str("relay", a.relay.base).Msg("couldn't get relayed messages")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayTransport sends the messages of the twins reachable through a relay,
+// with addresses like `relay://relay.example.com` (http) or `relays://...`
+// (https). The relay address has the usual formats (see parseTwinAddress).
+type relayTransport struct {
+	peers *peerTransport
+}
+
+func (t relayTransport) NewClient(twin int, endpoints []string) (TwinClient, error) {
+	var relays []string
+	for _, endpoint := range endpoints {
+		scheme := endpointScheme(endpoint)
+		address := strings.TrimPrefix(endpoint, scheme+"://")
+		if strings.Contains(address, "://") {
+			return nil, fmt.Errorf("invalid relay address '%s'", endpoint)
+		}
+		if scheme == "relays" {
+			address = "https://" + address
+		}
+		base, err := parseTwinAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		relays = append(relays, base)
+	}
+	return &twinClient{twin: twin, endpoints: relays, transport: t.peers, relay: true}, nil
+}
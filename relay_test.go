@@ -0,0 +1,229 @@
+package rmb
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/substrate-client"
+)
+
+// relayServer serves a relay as twin 3, with twins 1 and 2 using it
+func relayServer(t *testing.T) (*App, *BackendMock, *httptest.Server, substrate.Identity, substrate.Identity, testKeys) {
+	ed, sr, keys := testIdentities(t)
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = 3
+	identity, err := substrate.NewIdentityFromEd25519Key(ed25519.NewKeyFromSeed(seed))
+	require.NoError(t, err)
+	keys[3] = identity.PublicKey()
+
+	relay, backend := linkApp(identity, 3, keys)
+	relay.relayMode = true
+	router := mux.NewRouter()
+	router.HandleFunc("/zbus-remote", relay.remote)
+	router.HandleFunc("/zbus-reply", relay.reply)
+	router.HandleFunc(linkPath, relay.link)
+	router.HandleFunc(relayRegisterPath, relay.registerRelayed)
+	router.HandleFunc(relayPollPath, relay.pollRelayed)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return relay, backend, server, ed, sr, keys
+}
+
+// relayedClient sends to twin 2 through the relay
+func relayedClient(t *testing.T, relay *httptest.Server) TwinClient {
+	client, err := newTwinClient(testTransport(DefaultTransportConfig()), 2, "relay://"+strings.TrimPrefix(relay.URL, "http://"))
+	require.NoError(t, err)
+	return client
+}
+
+func TestRelayPoll(t *testing.T) {
+	relay, relayBackend, server, ed, sr, keys := relayServer(t)
+	relay.clockSkew = 10 * time.Minute
+	target, targetBackend := linkApp(sr, 2, keys)
+	var err error
+	target.relay, err = newRelayClient(server.URL, time.Minute)
+	require.NoError(t, err)
+	client := relayedClient(t, server)
+
+	// the twin is not registered yet
+	err = client.SendRemote(linkMessage(t, ed, 1, 2))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+
+	require.NoError(t, target.postRelay(context.Background(), relayRegisterPath, "register", "", nil))
+	registered, err := relayBackend.IsRelayed(context.Background(), 2)
+	require.NoError(t, err)
+	require.True(t, registered)
+
+	// the message is older than the target accepts from a peer, but it was
+	// held by the relay
+	old := linkMessage(t, ed, 1, 2)
+	old.Epoch = time.Now().Add(-5 * time.Minute).Unix()
+	require.NoError(t, old.Sign(ed))
+	require.NoError(t, client.SendRemote(old))
+	require.Len(t, relayBackend.relayQueues[2], 1)
+	require.Empty(t, relayBackend.remotes)
+
+	require.NoError(t, target.pollRelay(context.Background()))
+	require.Len(t, targetBackend.remotes, 1)
+	assert.Equal(t, old.ID, targetBackend.remotes[0].ID)
+	assert.Empty(t, relayBackend.relayQueues[2])
+
+	status, err := target.authenticate(context.Background(), &old)
+	assert.Error(t, err, "only the relayed messages are accepted late")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// an expired message is not delivered anymore
+	expired := linkMessage(t, ed, 1, 2)
+	expired.Epoch = time.Now().Add(-5 * time.Minute).Unix()
+	expired.Expiration = 60
+	require.NoError(t, expired.Sign(ed))
+	_, _, err = relay.relayMessage(context.Background(), expired, Remote)
+	require.NoError(t, err)
+	require.NoError(t, target.pollRelay(context.Background()))
+	assert.Len(t, targetBackend.remotes, 1)
+
+	// the relayed messages are not accepted after an hour, whatever their
+	// expiration
+	ancient := linkMessage(t, ed, 1, 2)
+	ancient.Epoch = time.Now().Add(-2 * time.Hour).Unix()
+	ancient.Expiration = 10 * 365 * 24 * 3600
+	require.NoError(t, ancient.Sign(ed))
+	status, err = target.authenticate(context.WithValue(context.Background(), relayedDelivery{}, true), &ancient)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestRelayPollLost(t *testing.T) {
+	relay, relayBackend, server, ed, sr, keys := relayServer(t)
+	target, targetBackend := linkApp(sr, 2, keys)
+	var err error
+	target.relay, err = newRelayClient(server.URL, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, target.postRelay(context.Background(), relayRegisterPath, "register", "", nil))
+
+	msg := linkMessage(t, ed, 1, 2)
+	_, _, err = relay.relayMessage(context.Background(), msg, Remote)
+	require.NoError(t, err)
+
+	// the response of a poll never reaches the twin
+	request, err := newRelayRequest(sr, "poll", 2, "")
+	require.NoError(t, err)
+	lost := httptest.NewRecorder()
+	relay.pollRelayed(lost, httptest.NewRequest(http.MethodPost, relayPollPath, relayBody(t, request)))
+	require.Equal(t, http.StatusOK, lost.Code)
+	require.Empty(t, relayBackend.relayQueues[2])
+
+	// the batch is sent again until the twin acknowledges it
+	require.NoError(t, target.pollRelay(context.Background()))
+	require.Len(t, targetBackend.remotes, 1)
+	assert.Equal(t, msg.ID, targetBackend.remotes[0].ID)
+	assert.Empty(t, relayBackend.relayInflight[2])
+	assert.Empty(t, target.relay.ack)
+}
+
+func TestRelayCommand(t *testing.T) {
+	relay, relayBackend, _, ed, _, _ := relayServer(t)
+	require.NoError(t, relayBackend.RegisterRelayed(context.Background(), 2, time.Minute))
+
+	// the commands of the local callers are not relayed
+	msg := linkMessage(t, ed, 1, 2)
+	body, err := json.Marshal(msg)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	relay.run(w, httptest.NewRequest(http.MethodPost, "/zbus-cmd", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var identifier MessageIdentifier
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&identifier))
+	assert.True(t, IsValidUUID(identifier.Retqueue))
+	assert.Empty(t, relayBackend.relayQueues[2])
+	require.Len(t, relayBackend.remotes, 1)
+	assert.True(t, relayBackend.remotes[0].Proxy)
+}
+
+func TestRelayLink(t *testing.T) {
+	relay, relayBackend, server, ed, sr, keys := relayServer(t)
+	target, targetBackend := linkApp(sr, 2, keys)
+	url, err := linkURL(server.URL)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go target.keepLink(ctx, url, true)
+	waitLink(t, relay, 2)
+
+	// the relay sends the message over the link of the twin right away, even
+	// if the twin is not registered
+	msg := linkMessage(t, ed, 1, 2)
+	require.NoError(t, relayedClient(t, server).SendRemote(msg))
+	require.Len(t, targetBackend.remotes, 1)
+	assert.Equal(t, msg.ID, targetBackend.remotes[0].ID)
+	assert.Empty(t, relayBackend.remotes)
+}
+
+func relayBody(t *testing.T, request relayRequest) io.Reader {
+	body, err := json.Marshal(request)
+	require.NoError(t, err)
+	return bytes.NewReader(body)
+}
+
+func TestRelayRequest(t *testing.T) {
+	relay, _, server, ed, sr, keys := relayServer(t)
+	target, _ := linkApp(sr, 2, keys)
+	var err error
+	target.relay, err = newRelayClient(server.URL, time.Minute)
+	require.NoError(t, err)
+
+	// twin 1 can't register as twin 2
+	request, err := newRelayRequest(ed, "register", 2, "")
+	require.NoError(t, err)
+	_, status, err := relay.verifyRelayRequest(httptest.NewRequest(http.MethodPost, relayRegisterPath, relayBody(t, request)), "register")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// the signature is bound to the action
+	request, err = newRelayRequest(sr, "register", 2, "")
+	require.NoError(t, err)
+	_, status, err = relay.verifyRelayRequest(httptest.NewRequest(http.MethodPost, relayPollPath, relayBody(t, request)), "poll")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	verified, _, err := relay.verifyRelayRequest(httptest.NewRequest(http.MethodPost, relayRegisterPath, relayBody(t, request)), "register")
+	require.NoError(t, err)
+	assert.Equal(t, 2, verified.Twin)
+	_, status, err = relay.verifyRelayRequest(httptest.NewRequest(http.MethodPost, relayRegisterPath, relayBody(t, request)), "register")
+	assert.Error(t, err, "requests can't be replayed")
+	assert.Equal(t, http.StatusConflict, status)
+}
+
+func TestRelayTransport(t *testing.T) {
+	transport := testTransport(DefaultTransportConfig())
+	for address, expected := range map[string]string{
+		"relay://relay.example.com":        "http://relay.example.com:8051",
+		"relay://10.0.0.1:9000":            "http://10.0.0.1:9000",
+		"relays://relay.example.com/rmb":   "https://relay.example.com/rmb",
+		"relay://http://relay.example.com": "",
+	} {
+		client, err := transport.registry.newClient(2, []string{address})
+		if expected == "" {
+			assert.Error(t, err, address)
+			continue
+		}
+		require.NoError(t, err, address)
+		require.IsType(t, &twinClient{}, client, address)
+		assert.True(t, client.(*twinClient).relay, address)
+		assert.Equal(t, []string{expected}, client.(*twinClient).endpoints, address)
+	}
+}
@@ -4,19 +4,21 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"regexp"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/threefoldtech/substrate-client"
 )
 
 func (a *Message) Valid() error {
-	if a.Version != 1 {
+	if a.Version != ProtocolV1 && a.Version != ProtocolV2 {
 		return errors.New("protocol version mismatch")
 	}
 
@@ -28,8 +30,12 @@ func (a *Message) Valid() error {
 		return errors.New("missing twin destination")
 	}
 
-	if a.Retqueue == "" {
-		return errors.New("return queue not defined")
+	if err := ValidateReturnQueue(a.Retqueue); err != nil {
+		return err
+	}
+
+	if a.Encrypted && a.Version < ProtocolV2 {
+		return errors.New("encrypted payload requires protocol version 2")
 	}
 
 	return nil
@@ -76,14 +82,43 @@ func (a *App) msgNeedsRetry(ctx context.Context, msg Message, err error) error {
 	return nil
 }
 
+// waitCircuit queues msg again until the circuit of dst is tried again, it
+// doesn't use a retry since the twin was not tried. The message fails once it
+// expires.
+func (a *App) waitCircuit(ctx context.Context, msg Message, dst int, err error) error {
+	if msg.Epoch == 0 {
+		msg.Epoch = time.Now().Unix()
+	}
+	if time.Now().After(msg.expiresAt()) {
+		if repErr := a.respondWithError(ctx, msg, err); repErr != nil {
+			return errors.Wrap(repErr, "failed to respond to the caller with the proper err")
+		}
+		return err
+	}
+	msg.TwinDst = []int{dst}
+	if qErr := a.backend.QueueRetry(ctx, msg); qErr != nil {
+		return errors.Wrap(qErr, "failed to queue msg for retry")
+	}
+	return err
+}
+
 func (a *App) handleFromLocalItem(ctx context.Context, msg Message, dst int) error {
+	// the circuit is checked before the message is prepared
+	if err := a.breakers.allow(dst); err != nil {
+		return a.waitCircuit(ctx, msg, dst, err)
+	}
+
 	msg.Epoch = time.Now().Unix()
 	update := msg
 	update.TwinSrc = a.twin
 	update.TwinDst = []int{dst}
 
 	var err error = nil
+	sent := false
 	defer func() {
+		if !sent {
+			a.breakers.cancel(dst)
+		}
 		if err != nil {
 			if repErr := a.msgNeedsRetry(ctx, msg, err); repErr != nil {
 				log.Error().Err(repErr).Msg("failed while processing message retry")
@@ -98,13 +133,18 @@ func (a *App) handleFromLocalItem(ctx context.Context, msg Message, dst int) err
 	}
 	update.ID = fmt.Sprintf("%d.%d", dst, id)
 	// anything better?
-	update.Retqueue = "msgbus.system.reply"
+	update.Retqueue = replyQueue
 
-	c, err := a.resolver.Resolve(dst)
+	c, err := a.resolve(dst)
 
 	if err != nil {
 		return errors.Wrap(err, "couldn't get twin ip")
 	}
+	if a.encrypt {
+		if err = a.encryptFor(&update, dst); err != nil {
+			return err
+		}
+	}
 	// time is set here to minimize the interval on which the signature is checked
 	// it's set before for checking when the messages expires when pushed to the backlog
 	update.Epoch = time.Now().Unix()
@@ -113,18 +153,88 @@ func (a *App) handleFromLocalItem(ctx context.Context, msg Message, dst int) err
 		return errors.Wrap(err, "couldn't sign message")
 	}
 	err = c.SendRemote(update)
+	sent = true
+	a.breakers.record(dst, err)
 
 	if err != nil {
+		a.invalidate(dst)
 		return err
 	}
 
-	err = a.backend.PushToBacklog(ctx, msg, update.ID)
+	// the backlog entry keeps only the twin the request was sent to, since
+	// it's the only one allowed to answer it
+	backlog := msg
+	backlog.TwinDst = []int{dst}
+	err = a.backend.PushToBacklog(ctx, backlog, update.ID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// invalidate drops the cached resolution of twin after a failure, so it's
+// resolved again on the next attempt
+func (a *App) invalidate(twin int) {
+	if invalidator, ok := a.resolver.(resolverInvalidator); ok {
+		invalidator.Invalidate(twin)
+	}
+}
+
+// invalidateKey drops the cached key of twin after an invalid signature, in case
+// it was rotated. Anyone can send a bad signature in the name of any twin, so
+// it's done at most once every rekeyInterval for each twin.
+func (a *App) invalidateKey(twin int) {
+	if a.rekeys != nil {
+		if err := a.rekeys.Add(fmt.Sprint(twin), true, cache.DefaultExpiration); err != nil {
+			return
+		}
+	}
+	a.invalidate(twin)
+}
+
+func (a *App) encryptFor(msg *Message, dst int) error {
+	pk, err := a.resolver.PublicKey(dst)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't get twin %d public key", dst)
+	}
+	if err := msg.Encrypt(pk); err != nil {
+		return errors.Wrap(err, "couldn't encrypt message")
+	}
+	return nil
+}
+
+// encryptedRequestKey identifies a request by its source and id, which its
+// reply carries back as destination and id
+func encryptedRequestKey(twin int, id string) string {
+	return fmt.Sprintf("%d/%s", twin, id)
+}
+
+// markEncrypted records a request that was received encrypted until it
+// expires, so its reply is encrypted as well
+func (a *App) markEncrypted(msg *Message) {
+	if a.encrypted == nil || !msg.Encrypted {
+		return
+	}
+	ttl := time.Until(msg.expiresAt())
+	if ttl <= 0 {
+		return
+	}
+	a.encrypted.Set(encryptedRequestKey(msg.TwinSrc, msg.ID), true, ttl)
+}
+
+// encryptReply checks if a reply must be encrypted, either because this twin
+// encrypts all its messages or because the request was encrypted
+func (a *App) encryptReply(msg *Message) bool {
+	if a.encrypt {
+		return true
+	}
+	if a.encrypted == nil {
+		return false
+	}
+	_, ok := a.encrypted.Get(encryptedRequestKey(msg.TwinDst[0], msg.ID))
+	return ok
+}
+
 func (a *App) handleFromLocal(ctx context.Context, msg Message) error {
 	for _, dst := range msg.TwinDst {
 		if err := a.handleFromLocalItem(ctx, msg, dst); err != nil {
@@ -134,7 +244,42 @@ func (a *App) handleFromLocal(ctx context.Context, msg Message) error {
 	return nil
 }
 
+// acceptCommand checks if a command received from a remote twin can be
+// forwarded to the local services
+func (a *App) acceptCommand(cmd string) error {
+	if err := ValidateCommand(cmd); err != nil {
+		return err
+	}
+	return a.commands.Accept(cmd)
+}
+
+// rejectRemote sends an error reply back to the twin that sent msg
+func (a *App) rejectRemote(ctx context.Context, msg Message, err error) error {
+	if msg.Proxy {
+		return a.respondWithError(ctx, msg, err)
+	}
+
+	reply := msg
+	reply.TwinSrc = a.twin
+	reply.TwinDst = []int{msg.TwinSrc}
+	reply.Data = ""
+	reply.Err = err.Error()
+	return a.backend.QueueReply(ctx, reply)
+}
+
 func (a *App) handleFromRemote(ctx context.Context, msg Message) error {
+	err := a.acceptCommand(msg.Command)
+	if err == nil && a.policy != nil {
+		err = a.policy.Check(msg.Command, msg.TwinSrc)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("id", msg.ID).Int("src", msg.TwinSrc).Msg("refusing remote message")
+		if repErr := a.rejectRemote(ctx, msg, err); repErr != nil {
+			return errors.Wrap(repErr, "couldn't reply to refused message")
+		}
+		return nil
+	}
+
 	log.Debug().Str("queue", fmt.Sprintf("msgbus.%s", msg.Command)).Msg("forwarding to local service")
 
 	// forward to local service
@@ -151,6 +296,16 @@ func (a *App) handleFromReplyForProxy(ctx context.Context, msg Message) error {
 	return nil
 }
 
+// isExpectedResponder checks if the request (from the backlog) was sent to twin
+func isExpectedResponder(request Message, twin int) bool {
+	for _, dst := range request.TwinDst {
+		if dst == twin {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *App) handleFromReplyForMe(ctx context.Context, msg Message) error {
 	log.Debug().Msg("message reply for me, fetching backlog")
 
@@ -158,6 +313,14 @@ func (a *App) handleFromReplyForMe(ctx context.Context, msg Message) error {
 	if err != nil {
 		return errors.Wrap(err, "error fetching message from backend")
 	}
+	if !isExpectedResponder(original, msg.TwinSrc) {
+		log.Warn().
+			Str("id", msg.ID).
+			Int("src", msg.TwinSrc).
+			Ints("expected", original.TwinDst).
+			Msg("suspicious reply received from a twin the request was not sent to")
+		return fmt.Errorf("reply '%s' from twin %d doesn't match the request destination", msg.ID, msg.TwinSrc)
+	}
 	// restore return queue name for the caller
 	msg.Retqueue = original.Retqueue
 
@@ -172,11 +335,27 @@ func (a *App) handleFromReplyForward(ctx context.Context, msg Message) error {
 	// reply have only one destination (source)
 	dst := msg.TwinDst[0]
 
-	r, err := a.resolver.Resolve(dst)
+	// the circuit is checked before the reply is prepared
+	if err := a.breakers.allow(dst); err != nil {
+		return errors.Wrap(err, "error forwarding reply from local service to the caller rmb")
+	}
+	sent := false
+	defer func() {
+		if !sent {
+			a.breakers.cancel(dst)
+		}
+	}()
+
+	r, err := a.resolve(dst)
 
 	if err != nil {
 		return errors.Wrap(err, "couldn't resolve twin ip")
 	}
+	if a.encryptReply(&msg) {
+		if err := a.encryptFor(&msg, dst); err != nil {
+			return err
+		}
+	}
 	msg.Epoch = time.Now().Unix()
 	err = msg.Sign(a.identity)
 	if err != nil {
@@ -185,8 +364,11 @@ func (a *App) handleFromReplyForward(ctx context.Context, msg Message) error {
 
 	// forward to reply agent
 	err = r.SendReply(msg)
+	sent = true
+	a.breakers.record(dst, err)
 
 	if err != nil {
+		a.invalidate(dst)
 		return errors.Wrap(err, "error forwarding reply from local service to the caller rmb")
 	}
 
@@ -309,7 +491,10 @@ func (a *App) runServer(ctx context.Context) {
 
 		if err := envelope.Valid(); err != nil {
 			log.Error().Err(err).Msg("received invalid message")
-			a.respondWithError(ctx, envelope.Message, errors.Wrap(err, "received invalid message"))
+			// this fails if the return queue itself is invalid, so the message is dropped
+			if repErr := a.respondWithError(ctx, envelope.Message, errors.Wrap(err, "received invalid message")); repErr != nil {
+				log.Error().Err(repErr).Str("id", envelope.ID).Msg("couldn't respond to invalid message")
+			}
 			continue
 		}
 
@@ -320,26 +505,135 @@ func (a *App) runServer(ctx context.Context) {
 		}
 	}
 }
+
+// rateLimited checks the rate limits of the message source twin. If the message
+// is refused it replies with 429 and returns true.
+func (a *App) rateLimited(w http.ResponseWriter, msg *Message) bool {
+	if a.limiter == nil {
+		return false
+	}
+
+	ok, wait := a.limiter.Allow(msg.TwinSrc, msg.Command)
+	if ok {
+		return false
+	}
+
+	log.Debug().Int("src", msg.TwinSrc).Str("cmd", msg.Command).Msg("rate limited")
+	w.Header().Set("Retry-After", retryAfter(wait))
+	errorReply(w, http.StatusTooManyRequests, "rate limit exceeded for twin %d, retry after %s", msg.TwinSrc, wait)
+	return true
+}
+
+// maxAge is how old a message can be when it's accepted. The messages held by
+// the relay of this twin are accepted until they expire (an hour at most, see
+// expiresAt), they can't be replayed within that time either.
+func (a *App) maxAge(ctx context.Context, msg *Message) time.Duration {
+	maxAge := a.clockSkew
+	if isRelayedDelivery(ctx) {
+		if lifetime := msg.expiresAt().Sub(time.Unix(msg.Epoch, 0)); lifetime > maxAge {
+			maxAge = lifetime
+		}
+	}
+	return maxAge
+}
+
+// authenticate validates the message timestamp and signature. On error it also
+// returns the http status that should be sent back.
+func (a *App) authenticate(ctx context.Context, msg *Message) (int, error) {
+	if err := msg.validateEpoch(a.maxAge(ctx, msg), a.clockSkew); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// the messages received from the grid relay were signed as envelopes
+	if !isEnvelopeDelivery(ctx) {
+		pk, keyType, err := a.twinKey(msg.TwinSrc)
+		if errors.Is(err, substrate.ErrNotFound) {
+			return http.StatusBadRequest, fmt.Errorf("source twin %d not found", msg.TwinSrc)
+		} else if err != nil {
+			return http.StatusBadGateway, fmt.Errorf("couldn't get twin %d public key: %s", msg.TwinSrc, err.Error())
+		}
+		if err := msg.verify(pk, keyType); err != nil {
+			a.invalidateKey(msg.TwinSrc)
+			return http.StatusBadRequest, err
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
+// checkReplay makes sure an authenticated message is not a replay of an already
+// received message. On error it also returns the http status that should be
+// sent back.
+func (a *App) checkReplay(ctx context.Context, msg *Message) (int, error) {
+	// the message can't be accepted anymore once it's too old, so it's enough
+	// to remember it until then.
+	ttl := time.Until(time.Unix(msg.Epoch, 0).Add(a.maxAge(ctx, msg)))
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	if err := a.backend.MarkSeen(ctx, msg.replayKey(), ttl); errors.Is(err, ErrReplayedMessage) {
+		return http.StatusConflict, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// admit authenticates the message, applies the rate limits of its (verified)
+// source twin and makes sure it's not a replay. If the message is refused, the
+// error is already sent back and it returns false.
+func (a *App) admit(w http.ResponseWriter, r *http.Request, msg *Message) bool {
+	if status, err := a.authenticate(r.Context(), msg); err != nil {
+		errorReply(w, status, "%s", err.Error())
+		return false
+	}
+	// the limits apply after the signature is verified, so a twin can't be
+	// limited by messages sent in its name. The replay check comes last, a
+	// limited message can be sent again later.
+	if a.rateLimited(w, msg) {
+		return false
+	}
+	if status, err := a.checkReplay(r.Context(), msg); err != nil {
+		errorReply(w, status, "%s", err.Error())
+		return false
+	}
+	return true
+}
+
 func (a *App) remote(w http.ResponseWriter, r *http.Request) {
 	var msg Message
 	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
 		errorReply(w, http.StatusBadRequest, "couldn't parse json")
 		return
 	}
-	if err := msg.ValidateEpoch(); err != nil {
-		errorReply(w, http.StatusBadRequest, err.Error())
+	if err := ValidateReturnQueue(msg.Retqueue); err != nil {
+		errorReply(w, http.StatusBadRequest, "%s", err.Error())
 		return
 	}
-	pk, err := a.resolver.PublicKey(msg.TwinSrc)
-	if errors.Is(err, substrate.ErrNotFound) {
-		errorReply(w, http.StatusBadRequest, "source twin %d not found", msg.TwinSrc)
+	if err := a.checkPeer(r, &msg); err != nil {
+		errorReply(w, http.StatusForbidden, "%s", err.Error())
 		return
-	} else if err != nil {
-		errorReply(w, http.StatusBadGateway, "couldn't get twin %d public key: %s", msg.TwinSrc, err.Error())
+	}
+	if !a.admit(w, r, &msg) {
 		return
 	}
-	if err := msg.Verify(pk); err != nil {
-		errorReply(w, http.StatusBadRequest, err.Error())
+	if handled, status, err := a.relayMessage(r.Context(), msg, Remote); handled {
+		if err != nil {
+			errorReply(w, status, "%s", err.Error())
+		} else {
+			successReply(w)
+		}
+		return
+	}
+	if err := a.acceptCommand(msg.Command); err != nil {
+		errorReply(w, http.StatusForbidden, "%s", err.Error())
+		return
+	}
+	// recorded before the request is queued, its reply can be sent right after
+	a.markEncrypted(&msg)
+	if err := msg.Decrypt(a.identity); err != nil {
+		errorReply(w, http.StatusBadRequest, "couldn't decrypt message payload: %s", err.Error())
 		return
 	}
 
@@ -357,28 +651,34 @@ func (a *App) reply(w http.ResponseWriter, r *http.Request) {
 		errorReply(w, http.StatusBadRequest, "couldn't parse json")
 		return
 	}
-
-	if err := msg.ValidateEpoch(); err != nil {
-		errorReply(w, http.StatusBadRequest, err.Error())
+	if err := ValidateReturnQueue(msg.Retqueue); err != nil {
+		errorReply(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+	if err := a.checkPeer(r, &msg); err != nil {
+		errorReply(w, http.StatusForbidden, "%s", err.Error())
 		return
 	}
 
-	pk, err := a.resolver.PublicKey(msg.TwinSrc)
-	if errors.Is(err, substrate.ErrNotFound) {
-		errorReply(w, http.StatusBadRequest, "source twin %d not found", msg.TwinSrc)
+	if !a.admit(w, r, &msg) {
 		return
-	} else if err != nil {
-		errorReply(w, http.StatusBadGateway, "couldn't get twin %d public key: %s", msg.TwinSrc, err.Error())
+	}
+	if handled, status, err := a.relayMessage(r.Context(), msg, Reply); handled {
+		if err != nil {
+			errorReply(w, status, "%s", err.Error())
+		} else {
+			successReply(w)
+		}
 		return
 	}
-	if err := msg.Verify(pk); err != nil {
-		errorReply(w, http.StatusBadRequest, err.Error())
+	if err := msg.Decrypt(a.identity); err != nil {
+		errorReply(w, http.StatusBadRequest, "couldn't decrypt message payload: %s", err.Error())
 		return
 	}
 
 	if err := a.backend.QueueReply(r.Context(), msg); err != nil {
 		err = errors.Wrap(err, "couldn't push entry to reply queue")
-		errorReply(w, http.StatusInternalServerError, err.Error())
+		errorReply(w, http.StatusInternalServerError, "%s", err.Error())
 		return
 	}
 	successReply(w)
@@ -391,21 +691,11 @@ func (a *App) run(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := msg.ValidateEpoch(); err != nil {
-		errorReply(w, http.StatusBadRequest, err.Error())
+	if !a.admit(w, r, &msg) {
 		return
 	}
-
-	pk, err := a.resolver.PublicKey(msg.TwinSrc)
-	if errors.Is(err, substrate.ErrNotFound) {
-		errorReply(w, http.StatusBadRequest, "source twin %d not found", msg.TwinSrc)
-		return
-	} else if err != nil {
-		errorReply(w, http.StatusBadGateway, "couldn't get twin %d public key: %s", msg.TwinSrc, err.Error())
-		return
-	}
-	if err := msg.Verify(pk); err != nil {
-		errorReply(w, http.StatusBadRequest, err.Error())
+	if err := a.acceptCommand(msg.Command); err != nil {
+		errorReply(w, http.StatusForbidden, "%s", err.Error())
 		return
 	}
 
@@ -439,7 +729,7 @@ func (a *App) getResult(w http.ResponseWriter, r *http.Request) {
 
 	response, err := a.backend.GetMessageReply(r.Context(), msgIdentifier)
 	if err != nil {
-		errorReply(w, http.StatusInternalServerError, err.Error())
+		errorReply(w, http.StatusInternalServerError, "%s", err.Error())
 		return
 	}
 	for idx := range response {
@@ -453,17 +743,137 @@ func (a *App) getResult(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(&response)
 }
 
+func (a *App) rateLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	stats := []RateLimitStats{}
+	if a.limiter != nil {
+		stats = a.limiter.Stats()
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (a *App) twinsHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.breakers.health())
+}
+
+func (a *App) serveAdmin(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		a.admin.Shutdown(shutdownCtx)
+	}()
+
+	log.Info().Str("address", a.admin.Addr).Msg("starting admin server")
+	if err := a.admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Error().Err(err).Msg("admin server exited unexpectedly")
+	}
+}
+
+// followTwinEvents evicts the twins changed on the chain from the resolver cache
+func (a *App) followTwinEvents(ctx context.Context) error {
+	evictor, ok := a.resolver.(resolverEvictor)
+	if !ok {
+		return nil
+	}
+	events, err := a.events.Events(ctx)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for event := range events {
+			log.Debug().Int("twin", event.Twin).Msg("twin changed, evicting from cache")
+			evictor.Evict(event.Twin)
+		}
+	}()
+	return nil
+}
+
+// twinIDResolver is implemented by the resolvers that can find the twin owning
+// a public key
+type twinIDResolver interface {
+	TwinID(publicKey []byte) (int, error)
+}
+
+// keyTypeResolver is implemented by the resolvers that know the key type of the
+// twins, the signatures of a twin must then be of that type. The key type is
+// empty if it's not known.
+type keyTypeResolver interface {
+	KeyType(twin int) (string, error)
+}
+
+// resolverInvalidator is implemented by the resolvers that cache twins
+type resolverInvalidator interface {
+	Invalidate(twin int)
+}
+
+// resolverEvictor is implemented by the resolvers that cache twins, to drop
+// twins changed on the chain
+type resolverEvictor interface {
+	Evict(twin int)
+}
+
+// resolverWatcher is implemented by the resolvers that reload their twins
+type resolverWatcher interface {
+	Watch(ctx context.Context, interval time.Duration)
+}
+
 func (a *App) Serve(root context.Context, mgr substrate.Manager) error {
 	ctx, cancel := context.WithCancel(root)
 	defer cancel()
 
-	sub, err := mgr.Substrate()
-	if err != nil {
-		return err
+	// the chain is optional if a resolver was set
+	var sub *substrate.Substrate
+	if mgr != nil {
+		var err error
+		sub, err = mgr.Substrate()
+		if err != nil {
+			return err
+		}
+		defer sub.Close()
+	}
+
+	if a.resolver == nil {
+		if sub == nil {
+			return fmt.Errorf("no twin resolver configured")
+		}
+		resolver, err := NewSubstrateResolver(sub)
+		if err != nil {
+			return err
+		}
+		resolver.(transportSetter).setTransport(a.peers)
+		a.resolver = NewCacheResolver(resolver, 5*time.Minute)
+		if a.events == nil {
+			a.events = NewSubstrateTwinEvents(mgr)
+		}
+	}
+	if a.events != nil {
+		if err := a.followTwinEvents(ctx); err != nil {
+			return errors.Wrap(err, "couldn't follow twin events")
+		}
+	}
+	if watcher, ok := a.resolver.(resolverWatcher); ok {
+		go watcher.Watch(ctx, 10*time.Second)
+	}
+	if a.policy != nil {
+		if sub != nil {
+			a.policy.setFarmMembership(NewSubstrateFarmMembership(sub, 5*time.Minute))
+		}
+		go a.policy.Watch(ctx, 10*time.Second)
+	}
+	if a.quicAddress != "" {
+		l, err := a.listenQUIC(a.quicAddress)
+		if err != nil {
+			return errors.Wrap(err, "couldn't listen for QUIC")
+		}
+		go func() {
+			if err := a.serveQUIC(ctx, l); err != nil && ctx.Err() == nil {
+				log.Error().Err(err).Str("address", a.quicAddress).Msg("failed to serve QUIC")
+			}
+		}()
 	}
-	defer sub.Close()
-	resolver, err := NewSubstrateResolver(sub)
-	a.resolver = NewCacheResolver(resolver, 5*time.Minute)
 	go a.runServer(ctx)
 
 	go func() {
@@ -471,44 +881,167 @@ func (a *App) Serve(root context.Context, mgr substrate.Manager) error {
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		a.server.Shutdown(shutdownCtx)
+		// the links are hijacked connections, they are not closed by Shutdown
+		a.links.closeAll()
 	}()
 
-	if err := a.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if a.admin != nil {
+		go a.serveAdmin(ctx)
+	}
+	for _, url := range a.linkURLs {
+		go a.keepLink(ctx, url, false)
+	}
+	if a.relay != nil {
+		go a.keepRelay(ctx)
+	}
+	if a.gridRelay != nil {
+		go a.keepGridRelay(ctx)
+	}
+	for _, l := range a.listeners {
+		go func(l net.Listener) {
+			if err := a.server.Serve(l); err != nil && err != http.ErrServerClosed {
+				log.Error().Err(err).Str("address", l.Addr().String()).Msg("failed to serve listener")
+			}
+		}(l)
+	}
+
+	serve := a.server.ListenAndServe
+	if a.serveTLS {
+		// the certificate is already in the TLS configuration
+		serve = func() error { return a.server.ListenAndServeTLS("", "") }
+	}
+	if err := serve(); err != nil && err != http.ErrServerClosed {
 		return err
 	}
 
 	return nil
 }
 
-func NewServer(mgr substrate.Manager, redisServer string, workers int, identity substrate.Identity) (*App, error) {
+// NewServer creates the msgbus server. mgr can be nil if the twins are resolved
+// without the chain (see WithResolver).
+func NewServer(mgr substrate.Manager, redisServer string, workers int, identity substrate.Identity, opts ...ServerOption) (*App, error) {
 	router := mux.NewRouter()
 	backend := NewRedisBackend(redisServer)
 
-	sub, err := mgr.Substrate()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to connect to substrate")
-	}
-	defer sub.Close()
-
-	twin, err := sub.GetTwinByPubKey(identity.PublicKey())
-	if err != nil {
-		return nil, errors.Wrap(err, "couldn't get twin associated with mnemonics")
-	}
-
 	a := &App{
 		backend:  backend,
 		identity: identity,
-		twin:     int(twin),
 		server: &http.Server{
 			Handler: router,
 			Addr:    "0.0.0.0:8051",
 		},
-		workers: workers,
+		workers:   workers,
+		clockSkew: DefaultClockSkew,
+		transport: DefaultTransportConfig(),
+		breaker:   DefaultBreakerConfig(),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	if err := a.transport.Valid(); err != nil {
+		return nil, errors.Wrap(err, "invalid transport configuration")
+	}
+	peers, err := newPeerTransport(a.transport)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid transport configuration")
+	}
+	a.peers = peers
+	for _, registered := range a.transports {
+		a.peers.registry.register(registered.transport, registered.schemes...)
+	}
+	if err := a.breaker.Valid(); err != nil {
+		return nil, errors.Wrap(err, "invalid circuit breaker configuration")
+	}
+	a.breakers = newBreakers(a.breaker)
+	a.handshakes = newHandshakeLimiter()
+	a.rekeys = cache.New(rekeyInterval, 10*time.Minute)
+	a.encrypted = cache.New(cache.NoExpiration, 10*time.Minute)
+	a.links = newPeerLinks()
+	for i, address := range a.linkURLs {
+		url, err := linkURL(address)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid peer link")
+		}
+		a.linkURLs[i] = url
+	}
+	if a.relayAddress != "" {
+		relay, err := newRelayClient(a.relayAddress, a.relayPoll)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid relay")
+		}
+		a.relay = relay
 	}
+	if setter, ok := a.resolver.(transportSetter); ok {
+		setter.setTransport(a.peers)
+	}
+
+	twin, err := a.ownTwin(mgr)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't get twin associated with mnemonics")
+	}
+	a.twin = twin
+
+	// the certificate is also presented to the https peers when TLS is not
+	// served, so they can verify this twin
+	a.certificate, err = newTwinCertificate(identity, twin)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create twin certificate")
+	}
+	a.peers.setIdentity(&a.certificate, a.twinKey)
+	if a.gridRelayURL != "" {
+		if a.encrypt {
+			// the envelopes of the newer rmb are encrypted with its own scheme
+			return nil, fmt.Errorf("encryption can't be used with the grid relay")
+		}
+		a.gridRelay, err = newGridRelay(a.gridRelayURL, identity, twin, a.transport.RequestTimeout)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid grid relay")
+		}
+		a.peers.registry.register(gridTransport{a.gridRelay}, "ws", "wss")
+	}
+	if a.serveTLS {
+		a.server.TLSConfig = a.serverTLSConfig()
+	}
+
 	router.HandleFunc("/zbus-reply", a.reply)
 	router.HandleFunc("/zbus-remote", a.remote)
 	router.HandleFunc("/zbus-cmd", a.run)
 	router.HandleFunc("/zbus-result", a.getResult)
+	router.HandleFunc(linkPath, a.link)
+	if a.relayMode {
+		router.HandleFunc(relayRegisterPath, a.registerRelayed).Methods(http.MethodPost)
+		router.HandleFunc(relayPollPath, a.pollRelayed).Methods(http.MethodPost)
+	}
+
+	if a.admin != nil {
+		admin := a.admin.Handler.(*mux.Router)
+		admin.HandleFunc("/admin/ratelimits", a.rateLimits).Methods(http.MethodGet)
+		admin.HandleFunc("/admin/twins", a.twinsHealth).Methods(http.MethodGet)
+	}
 
 	return a, nil
 }
+
+// ownTwin finds the twin of the server identity, from the resolver if it can or
+// from the chain
+func (a *App) ownTwin(mgr substrate.Manager) (int, error) {
+	if lookup, ok := a.resolver.(twinIDResolver); ok {
+		return lookup.TwinID(a.identity.PublicKey())
+	}
+	if mgr == nil {
+		return 0, fmt.Errorf("resolver can't find twins by public key and no substrate manager is set")
+	}
+
+	sub, err := mgr.Substrate()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to connect to substrate")
+	}
+	defer sub.Close()
+
+	twin, err := sub.GetTwinByPubKey(a.identity.PublicKey())
+	if err != nil {
+		return 0, err
+	}
+	return int(twin), nil
+}
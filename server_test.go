@@ -1,16 +1,26 @@
 package rmb
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"github.com/threefoldtech/substrate-client"
 )
 
 type BackendMock struct {
@@ -22,6 +32,11 @@ type BackendMock struct {
 	commandMsgs    map[string][]Message
 	commandReplies map[string][]Message
 	ids            map[int]int
+	seen           map[string]time.Time
+	relayed        map[int]time.Time
+	relayQueues    map[int][]relayedEntry
+	relayInflight  map[int][]relayedEntry
+	relayBatches   map[int]string
 }
 
 func NewBackendMock() *BackendMock {
@@ -34,6 +49,11 @@ func NewBackendMock() *BackendMock {
 		commandMsgs:    make(map[string][]Message),
 		commandReplies: make(map[string][]Message),
 		ids:            make(map[int]int),
+		seen:           make(map[string]time.Time),
+		relayed:        make(map[int]time.Time),
+		relayQueues:    make(map[int][]relayedEntry),
+		relayInflight:  make(map[int][]relayedEntry),
+		relayBatches:   make(map[int]string),
 	}
 	return r
 }
@@ -90,6 +110,10 @@ func (r *BackendMock) IncrementID(ctx context.Context, id int) (int64, error) {
 	return int64(old), nil
 }
 
+func (r *BackendMock) GetMessageReply(ctx context.Context, msg MessageIdentifier) ([]Message, error) {
+	return r.commandReplies[msg.Retqueue], nil
+}
+
 func (r *BackendMock) PushToBacklog(ctx context.Context, msg Message, id string) error {
 	r.backlog[id] = msg
 	return nil
@@ -155,13 +179,69 @@ func (r *BackendMock) PopExpiredBacklogMessages(ctx context.Context) ([]Message,
 	return msgs, nil
 }
 
+func (r *BackendMock) MarkSeen(ctx context.Context, key string, ttl time.Duration) error {
+	if expiration, ok := r.seen[key]; ok && time.Now().Before(expiration) {
+		return ErrReplayedMessage
+	}
+	r.seen[key] = time.Now().Add(ttl)
+	return nil
+}
+
+func (r *BackendMock) RegisterRelayed(ctx context.Context, twin int, ttl time.Duration) error {
+	r.relayed[twin] = time.Now().Add(ttl)
+	return nil
+}
+
+func (r *BackendMock) IsRelayed(ctx context.Context, twin int) (bool, error) {
+	expiration, ok := r.relayed[twin]
+	return ok && time.Now().Before(expiration), nil
+}
+
+func (r *BackendMock) PushRelayed(ctx context.Context, twin int, envelope Envelope, expiration time.Time) error {
+	r.relayQueues[twin] = append(r.relayQueues[twin], relayedEntry{Envelope: envelope, Expiration: expiration.Unix()})
+	return nil
+}
+
+func (r *BackendMock) NextRelayed(ctx context.Context, twin int, max int) (string, []Envelope, error) {
+	if _, ok := r.relayBatches[twin]; !ok {
+		queue := r.relayQueues[twin]
+		if len(queue) == 0 {
+			return "", []Envelope{}, nil
+		}
+		if len(queue) > max {
+			queue = queue[:max]
+		}
+		r.relayInflight[twin] = queue
+		r.relayQueues[twin] = r.relayQueues[twin][len(queue):]
+		r.relayBatches[twin] = uuid.New().String()
+	}
+
+	envelopes := []Envelope{}
+	for _, entry := range r.relayInflight[twin] {
+		if entry.Expiration >= time.Now().Unix() {
+			envelopes = append(envelopes, entry.Envelope)
+		}
+	}
+	return r.relayBatches[twin], envelopes, nil
+}
+
+func (r *BackendMock) AckRelayed(ctx context.Context, twin int, batch string) error {
+	if r.relayBatches[twin] == batch {
+		delete(r.relayBatches, twin)
+		delete(r.relayInflight, twin)
+	}
+	return nil
+}
+
 type ResolverMock struct {
 	twin map[int]*TwinClientMock
+	pk   map[int][]byte
 }
 
 func NewResolverMock() ResolverMock {
 	r := ResolverMock{
 		twin: make(map[int]*TwinClientMock),
+		pk:   make(map[int][]byte),
 	}
 	return r
 }
@@ -186,6 +266,14 @@ func (r ResolverMock) Resolve(timeID int) (TwinClient, error) {
 	return e, nil
 }
 
+func (r ResolverMock) PublicKey(timeID int) ([]byte, error) {
+	pk, ok := r.pk[timeID]
+	if !ok {
+		return nil, errors.Wrapf(substrate.ErrNotFound, "twin %d not found", timeID)
+	}
+	return pk, nil
+}
+
 func (c *TwinClientMock) SendRemote(data Message) error {
 	log.Debug().Int("twin", c.timeID).Msg("sending remote")
 	c.remote = append(c.remote, data)
@@ -207,16 +295,20 @@ func (c *TwinClientMock) PopReply() Message {
 	c.reply = c.reply[:len(c.reply)-1]
 	return last
 }
-func setup(ctrl *gomock.Controller) (a App, s Backend, r TwinResolver) {
-	// backend := NewBackendMock()
-	// resolver := NewResolverMock()
+func setup(ctrl *gomock.Controller) (a App, s *BackendMock, r ResolverMock) {
+	backend := NewBackendMock()
+	resolver := NewResolverMock()
+	identity, err := substrate.NewIdentityFromEd25519Key(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	if err != nil {
+		panic(err)
+	}
 
-	backend := NewMockBackend(ctrl)
-	resolver := NewMockTwinResolver(ctrl)
 	app := App{
-		backend:  backend,
-		twin:     1,
-		resolver: resolver,
+		backend:   backend,
+		identity:  identity,
+		twin:      1,
+		resolver:  resolver,
+		clockSkew: DefaultClockSkew,
 	}
 
 	return app, backend, resolver
@@ -351,6 +443,8 @@ func TestHandleFromReplyForMe(t *testing.T) {
 		Err:        "",
 	}
 	update := msg
+	update.TwinSrc = 2
+	update.TwinDst = []int{0}
 	update.Retqueue = "msgbug.system.reply"
 	update.Data = base64.StdEncoding.EncodeToString([]byte("result"))
 
@@ -371,3 +465,383 @@ func TestHandleFromReplyForMe(t *testing.T) {
 	assert.Equal(t, res.Retry, update.Retry)
 	assert.Equal(t, res.Data, update.Data)
 }
+
+func TestMessageSignVersions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	app, _, _ := setup(ctrl)
+
+	for _, version := range []int{ProtocolV1, ProtocolV2} {
+		msg := Message{
+			Version:  version,
+			ID:       "2.1",
+			Command:  "griddb.twins.get",
+			Data:     base64.StdEncoding.EncodeToString([]byte("2")),
+			TwinSrc:  1,
+			TwinDst:  []int{2},
+			Retqueue: "msgbus.system.reply",
+			Epoch:    time.Now().Unix(),
+		}
+		assert.NoError(t, msg.Sign(app.identity))
+		assert.NoError(t, msg.Verify(app.identity.PublicKey()), "version %d", version)
+		assert.NoError(t, msg.Valid())
+	}
+
+	msg := Message{Version: 3}
+	assert.Error(t, msg.Sign(app.identity))
+}
+
+func TestMessageChallengeV2Unambiguous(t *testing.T) {
+	first := Message{Version: ProtocolV2, Command: "ab", Data: "c"}
+	second := Message{Version: ProtocolV2, Command: "a", Data: "bc"}
+
+	c1, err := first.challenge()
+	assert.NoError(t, err)
+	c2, err := second.challenge()
+	assert.NoError(t, err)
+	assert.NotEqual(t, c1, c2)
+}
+
+func TestMessageTamperedFields(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	app, _, _ := setup(ctrl)
+
+	msg := Message{
+		Version:    ProtocolV2,
+		ID:         "2.1",
+		Command:    "griddb.twins.get",
+		Expiration: 60,
+		Retry:      2,
+		Data:       base64.StdEncoding.EncodeToString([]byte("2")),
+		TwinSrc:    1,
+		TwinDst:    []int{2},
+		Retqueue:   "msgbus.system.reply",
+		Schema:     "application/json",
+		Epoch:      time.Now().Unix(),
+		Err:        "",
+	}
+	assert.NoError(t, msg.Sign(app.identity))
+	assert.NoError(t, msg.Verify(app.identity.PublicKey()))
+
+	typ := reflect.TypeOf(msg)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Name == "Signature" {
+			continue
+		}
+		tampered := msg
+		tampered.TwinDst = append([]int{}, msg.TwinDst...)
+		value := reflect.ValueOf(&tampered).Elem().Field(i)
+		switch value.Kind() {
+		case reflect.String:
+			value.SetString(value.String() + "x")
+		case reflect.Int, reflect.Int64:
+			value.SetInt(value.Int() + 1)
+		case reflect.Bool:
+			value.SetBool(!value.Bool())
+		case reflect.Slice:
+			value.Index(0).SetInt(value.Index(0).Int() + 1)
+		default:
+			t.Fatalf("field %s of kind %s is not covered by the test", field.Name, value.Kind())
+		}
+		assert.Error(t, tampered.Verify(app.identity.PublicKey()), "tampering with %s must break the signature", field.Name)
+	}
+}
+
+func TestRemoteReplayedMessage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	app, backend, resolver := setup(ctrl)
+	resolver.pk[2] = app.identity.PublicKey()
+
+	msg := Message{
+		Version:  ProtocolV2,
+		ID:       "1.1",
+		Command:  "griddb.twins.get",
+		Data:     base64.StdEncoding.EncodeToString([]byte("2")),
+		TwinSrc:  2,
+		TwinDst:  []int{1},
+		Retqueue: "msgbus.system.reply",
+		Epoch:    time.Now().Unix(),
+	}
+	assert.NoError(t, msg.Sign(app.identity))
+	body, err := json.Marshal(msg)
+	assert.NoError(t, err)
+
+	send := func() int {
+		w := httptest.NewRecorder()
+		app.remote(w, httptest.NewRequest(http.MethodPost, "/zbus-remote", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, http.StatusConflict, send())
+	assert.Len(t, backend.remotes, 1)
+
+	// other encodings of the signature are not new messages
+	recased := msg
+	recased.Signature = strings.ToUpper(msg.Signature)
+	body, err = json.Marshal(recased)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, send())
+	assert.Len(t, backend.remotes, 1)
+}
+
+func TestRemoteReplayedPaddedSignature(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	app, backend, resolver := setup(ctrl)
+	identity, err := substrate.NewIdentityFromSr25519Phrase(testMnemonics)
+	assert.NoError(t, err)
+	resolver.pk[2] = identity.PublicKey()
+
+	msg := Message{
+		Version:  ProtocolV2,
+		ID:       "1.1",
+		Command:  "griddb.twins.get",
+		TwinSrc:  2,
+		TwinDst:  []int{1},
+		Retqueue: "msgbus.system.reply",
+		Epoch:    time.Now().Unix(),
+	}
+	assert.NoError(t, msg.Sign(identity))
+	send := func(msg Message) int {
+		body, err := json.Marshal(msg)
+		assert.NoError(t, err)
+		w := httptest.NewRecorder()
+		app.remote(w, httptest.NewRequest(http.MethodPost, "/zbus-remote", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send(msg))
+	// the sr25519 signature with trailing bytes is refused
+	padded := msg
+	padded.Signature += "00"
+	assert.Equal(t, http.StatusBadRequest, send(padded))
+	assert.Len(t, backend.remotes, 1)
+}
+
+func TestValidateEpochSkew(t *testing.T) {
+	msg := Message{Epoch: time.Now().Unix()}
+	assert.NoError(t, msg.ValidateEpochSkew(10*time.Second))
+
+	msg.Epoch = time.Now().Add(-time.Minute).Unix()
+	assert.Error(t, msg.ValidateEpochSkew(10*time.Second))
+	assert.NoError(t, msg.ValidateEpochSkew(2*time.Minute))
+
+	msg.Epoch = time.Now().Add(time.Minute).Unix()
+	assert.True(t, errors.Is(msg.ValidateEpochSkew(10*time.Second), ErrFutureMessage))
+	assert.NoError(t, msg.ValidateEpochSkew(2*time.Minute))
+}
+
+func TestHandleFromReplyForMeUnexpectedResponder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	app, backend, _ := setup(ctrl)
+	msg := Message{
+		Version:  1,
+		ID:       "2.7",
+		Command:  "griddb.twins.get",
+		TwinSrc:  1,
+		TwinDst:  []int{2},
+		Retqueue: uuid.New().String(),
+		Epoch:    time.Now().Unix(),
+	}
+	backend.PushToBacklog(context.TODO(), msg, msg.ID)
+
+	update := msg
+	update.TwinSrc = 3
+	update.TwinDst = []int{1}
+	update.Retqueue = "msgbus.system.reply"
+
+	assert.Error(t, app.handleFromReplyForMe(context.TODO(), update))
+	assert.Empty(t, backend.commandReplies[msg.Retqueue])
+
+	update.TwinSrc = 2
+	assert.NoError(t, app.handleFromReplyForMe(context.TODO(), update))
+	assert.Len(t, backend.commandReplies[msg.Retqueue], 1)
+}
+
+func TestReplyInvalidReturnQueue(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	app, backend, resolver := setup(ctrl)
+	resolver.pk[2] = app.identity.PublicKey()
+
+	msg := Message{
+		Version:  ProtocolV2,
+		ID:       "1.1",
+		Command:  "griddb.twins.get",
+		TwinSrc:  2,
+		TwinDst:  []int{1},
+		Retqueue: "msgbus.system.local",
+		Epoch:    time.Now().Unix(),
+		Proxy:    true,
+	}
+	assert.NoError(t, msg.Sign(app.identity))
+	body, err := json.Marshal(msg)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	app.reply(w, httptest.NewRequest(http.MethodPost, "/zbus-reply", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, backend.replies)
+}
+
+func TestHandleFromRemoteRefused(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	app, backend, _ := setup(ctrl)
+	app.policy = &PolicyStore{policy: Policy{Default: PolicyDeny}}
+
+	msg := Message{
+		Version:  ProtocolV2,
+		ID:       "1.3",
+		Command:  "griddb.twins.get",
+		Data:     base64.StdEncoding.EncodeToString([]byte("2")),
+		TwinSrc:  2,
+		TwinDst:  []int{1},
+		Retqueue: "msgbus.system.reply",
+		Epoch:    time.Now().Unix(),
+	}
+	assert.NoError(t, app.handleFromRemote(context.TODO(), msg))
+	assert.Empty(t, backend.commandMsgs["griddb.twins.get"])
+
+	// an error reply is sent back to the caller
+	assert.Len(t, backend.replies, 1)
+	reply := backend.replies[0]
+	assert.Equal(t, msg.ID, reply.ID)
+	assert.Equal(t, 1, reply.TwinSrc)
+	assert.Equal(t, []int{2}, reply.TwinDst)
+	assert.Contains(t, reply.Err, "access denied")
+}
+
+func TestEncryptedRequestReply(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	app, backend, resolver := setup(ctrl)
+	app.encrypted = cache.New(cache.NoExpiration, time.Minute)
+	resolver.pk[2] = app.identity.PublicKey()
+
+	// the responder doesn't encrypt its own messages
+	assert.False(t, app.encrypt)
+	msg := Message{
+		Version:  ProtocolV2,
+		ID:       "1.4",
+		Command:  "griddb.twins.get",
+		Data:     base64.StdEncoding.EncodeToString([]byte("ping")),
+		TwinSrc:  2,
+		TwinDst:  []int{1},
+		Retqueue: "msgbus.system.reply",
+		Epoch:    time.Now().Unix(),
+	}
+	assert.NoError(t, msg.Encrypt(app.identity.PublicKey()))
+	assert.NoError(t, msg.Sign(app.identity))
+	body, err := json.Marshal(msg)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	app.remote(w, httptest.NewRequest(http.MethodPost, "/zbus-remote", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, backend.remotes, 1)
+	request := backend.remotes[0]
+	assert.False(t, request.Encrypted)
+
+	reply := request
+	reply.TwinSrc = 1
+	reply.TwinDst = []int{2}
+	reply.Data = base64.StdEncoding.EncodeToString([]byte("pong"))
+	assert.NoError(t, app.handleFromReplyForward(context.TODO(), reply))
+
+	caller, _ := resolver.Resolve(2)
+	sent := caller.(*TwinClientMock).PopReply()
+	assert.True(t, sent.Encrypted)
+	assert.NoError(t, sent.Decrypt(app.identity))
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("pong")), sent.Data)
+
+	// replies to plain requests are not encrypted
+	reply.ID = "1.5"
+	assert.NoError(t, app.handleFromReplyForward(context.TODO(), reply))
+	assert.False(t, caller.(*TwinClientMock).PopReply().Encrypted)
+}
+
+func TestRemoteRateLimited(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	app, _, resolver := setup(ctrl)
+	resolver.pk[2] = app.identity.PublicKey()
+	app.limiter = NewRateLimiter(RateLimits{
+		Default: TwinRateLimits{Twin: RateLimit{Rate: 0.1, Burst: 1}},
+	})
+
+	send := func(id string) *httptest.ResponseRecorder {
+		msg := Message{
+			Version:  ProtocolV2,
+			ID:       id,
+			Command:  "griddb.twins.get",
+			TwinSrc:  2,
+			TwinDst:  []int{1},
+			Retqueue: "msgbus.system.reply",
+			Epoch:    time.Now().Unix(),
+		}
+		assert.NoError(t, msg.Sign(app.identity))
+		body, err := json.Marshal(msg)
+		assert.NoError(t, err)
+		w := httptest.NewRecorder()
+		app.remote(w, httptest.NewRequest(http.MethodPost, "/zbus-remote", bytes.NewReader(body)))
+		return w
+	}
+
+	// messages sent in the name of the twin don't use its limit
+	forged := Message{
+		Version:   ProtocolV2,
+		ID:        "1.0",
+		Command:   "griddb.twins.get",
+		TwinSrc:   2,
+		TwinDst:   []int{1},
+		Retqueue:  "msgbus.system.reply",
+		Epoch:     time.Now().Unix(),
+		Signature: "00",
+	}
+	body, err := json.Marshal(forged)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	app.remote(w, httptest.NewRequest(http.MethodPost, "/zbus-remote", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	assert.Equal(t, http.StatusOK, send("1.1").Code)
+	w = send("1.2")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Retry-After"))
+}
+
+// invalidatingResolver counts the invalidations of the twins
+type invalidatingResolver struct {
+	ResolverMock
+	invalidated map[int]int
+}
+
+func (r *invalidatingResolver) Invalidate(twin int) {
+	r.invalidated[twin]++
+}
+
+func TestRemoteBadSignatureInvalidation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	app, _, mock := setup(ctrl)
+	mock.pk[2] = app.identity.PublicKey()
+	resolver := &invalidatingResolver{ResolverMock: mock, invalidated: make(map[int]int)}
+	app.resolver = resolver
+	app.rekeys = cache.New(rekeyInterval, time.Minute)
+
+	// the key of the twin is looked up again once for a flood of bad signatures
+	for i := 0; i < 10; i++ {
+		forged := Message{
+			Version:   ProtocolV2,
+			ID:        uuid.New().String(),
+			Command:   "griddb.twins.get",
+			TwinSrc:   2,
+			TwinDst:   []int{1},
+			Retqueue:  "msgbus.system.reply",
+			Epoch:     time.Now().Unix(),
+			Signature: "00",
+		}
+		body, err := json.Marshal(forged)
+		assert.NoError(t, err)
+		w := httptest.NewRecorder()
+		app.remote(w, httptest.NewRequest(http.MethodPost, "/zbus-remote", bytes.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	}
+	assert.Equal(t, 1, resolver.invalidated[2])
+}
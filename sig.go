@@ -14,6 +14,9 @@ import (
 const (
 	SignatureTypeEd25519 = "ed25519"
 	SignatureTypeSr25519 = "sr25519"
+
+	// signatureSize is the size of both ed25519 and sr25519 signatures
+	signatureSize = 64
 )
 
 type Verifier interface {
@@ -24,6 +27,9 @@ type Ed25519VerifyingKey []byte
 type Sr25519VerifyingKey []byte
 
 func (k Ed25519VerifyingKey) Verify(msg []byte, sig []byte) bool {
+	if len(sig) != signatureSize {
+		return false
+	}
 	return ed25519.Verify([]byte(k), msg, sig)
 }
 
@@ -32,7 +38,12 @@ func signingContext(msg []byte) *merlin.Transcript {
 }
 
 func (k Sr25519VerifyingKey) verify(pub sr25519.PublicKey, msg []byte, signature []byte) bool {
-	var sigs [64]byte
+	// the signature must not have trailing bytes, they would give another
+	// encoding of the same signature
+	if len(signature) != signatureSize {
+		return false
+	}
+	var sigs [signatureSize]byte
 	copy(sigs[:], signature)
 	sig := new(sr25519.Signature)
 	if err := sig.Decode(sigs); err != nil {
@@ -67,7 +78,13 @@ func (k Sr25519VerifyingKey) Verify(msg []byte, sig []byte) bool {
 	return k.verify(*pk, msg, sig)
 }
 
-func constructVerifier(publicKey []byte, key_type string) (Verifier, error) {
+// constructVerifier returns the verifier of a signature of key_type. twinKeyType
+// is the key type of the signer if it's known (see keyTypeResolver), the
+// signatures of another type are refused then.
+func constructVerifier(publicKey []byte, key_type string, twinKeyType string) (Verifier, error) {
+	if twinKeyType != "" && key_type != twinKeyType {
+		return nil, fmt.Errorf("%s signature doesn't match the %s key of the twin", key_type, twinKeyType)
+	}
 	if key_type == SignatureTypeEd25519 {
 		return Ed25519VerifyingKey(publicKey), nil
 	} else if key_type == SignatureTypeSr25519 {
@@ -77,6 +94,19 @@ func constructVerifier(publicKey []byte, key_type string) (Verifier, error) {
 	}
 }
 
+// decodeSignature decodes a hex encoded signature, only the lower case encoding
+// is accepted so each signature has a single encoding
+func decodeSignature(signature string) ([]byte, error) {
+	decoded, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(decoded) != signature {
+		return nil, fmt.Errorf("signature must be lower case hex")
+	}
+	return decoded, nil
+}
+
 func sigTypeToChar(sigType string) (byte, error) {
 	if sigType == SignatureTypeEd25519 {
 		return byte('e'), nil
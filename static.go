@@ -0,0 +1,201 @@
+package rmb
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/substrate-client"
+	"gopkg.in/yaml.v2"
+)
+
+// StaticTwin is a twin entry of the static resolver file
+type StaticTwin struct {
+	ID int `yaml:"id" json:"id"`
+	// Address is the twin address, Addresses can be used instead if the twin
+	// is reachable on more than one address (they are tried in order).
+	Address   string   `yaml:"address" json:"address"`
+	Addresses []string `yaml:"addresses" json:"addresses"`
+	// PublicKey is the hex encoded public key of the twin (0x prefix is optional),
+	// or its SS58 account address.
+	PublicKey string `yaml:"public_key" json:"public_key"`
+	// KeyType is the type of the key, ed25519 or sr25519. The signatures of the
+	// twin must be of that type.
+	KeyType string `yaml:"key_type" json:"key_type"`
+}
+
+// StaticTwins is the content of the static resolver file, it can be written in
+// yaml or json
+//
+//	twins:
+//	  - id: 1
+//	    addresses: [10.10.0.1, "[300:e9d7:b14f:8b32::1]"]
+//	    public_key: 0x2a8b5e3e...
+//	    key_type: ed25519
+type StaticTwins struct {
+	Twins []StaticTwin `yaml:"twins" json:"twins"`
+}
+
+type staticTwin struct {
+	addresses []string
+	publicKey []byte
+	keyType   string
+}
+
+// StaticResolver resolves twins from a file instead of the chain, for private
+// deployments where the chain is not reachable. The file is reloaded without a
+// restart when it changes.
+type StaticResolver struct {
+	file      string
+	m         sync.RWMutex
+	twins     map[int]staticTwin
+	transport *peerTransport
+}
+
+// NewStaticResolver loads the twins from file
+func NewStaticResolver(file string) (*StaticResolver, error) {
+	resolver := &StaticResolver{file: file}
+	if err := resolver.Reload(); err != nil {
+		return nil, err
+	}
+	return resolver, nil
+}
+
+// loadStaticTwins loads and validates a static resolver file
+func loadStaticTwins(file string) (map[int]staticTwin, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read twins file")
+	}
+	// json documents are valid yaml
+	var content StaticTwins
+	if err := yaml.UnmarshalStrict(data, &content); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse twins file")
+	}
+
+	twins := make(map[int]staticTwin, len(content.Twins))
+	for _, twin := range content.Twins {
+		if _, ok := twins[twin.ID]; ok {
+			return nil, fmt.Errorf("twin %d is defined more than once", twin.ID)
+		}
+		entry, err := twin.parse()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid twin %d", twin.ID)
+		}
+		twins[twin.ID] = entry
+	}
+
+	return twins, nil
+}
+
+func (t *StaticTwin) parse() (staticTwin, error) {
+	if t.ID <= 0 {
+		return staticTwin{}, fmt.Errorf("invalid twin id")
+	}
+	addresses := append([]string{t.Address}, t.Addresses...)
+	if _, err := parseTwinAddresses(addresses...); err != nil {
+		return staticTwin{}, err
+	}
+	if t.KeyType != SignatureTypeEd25519 && t.KeyType != SignatureTypeSr25519 {
+		return staticTwin{}, fmt.Errorf("invalid key type '%s'", t.KeyType)
+	}
+
+	pk, err := hex.DecodeString(strings.TrimPrefix(t.PublicKey, "0x"))
+	if err != nil {
+		account, err := substrate.FromAddress(t.PublicKey)
+		if err != nil {
+			return staticTwin{}, fmt.Errorf("public key is neither hex encoded nor an account address")
+		}
+		pk = account.PublicKey()
+	}
+	if len(pk) != 32 {
+		return staticTwin{}, fmt.Errorf("invalid public key length %d", len(pk))
+	}
+
+	return staticTwin{addresses: addresses, publicKey: pk, keyType: t.KeyType}, nil
+}
+
+// Reload loads the twins file again. The current twins are kept if the file
+// is not valid.
+func (r *StaticResolver) Reload() error {
+	twins, err := loadStaticTwins(r.file)
+	if err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.twins = twins
+	return nil
+}
+
+// Watch reloads the twins each time the file changes, until ctx is canceled
+func (r *StaticResolver) Watch(ctx context.Context, interval time.Duration) {
+	watchFile(ctx, r.file, interval, r.Reload)
+}
+
+func (r *StaticResolver) get(twin int) (staticTwin, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	entry, ok := r.twins[twin]
+	if !ok {
+		return staticTwin{}, errors.Wrapf(substrate.ErrNotFound, "twin %d is not in the twins file", twin)
+	}
+	return entry, nil
+}
+
+func (r *StaticResolver) Resolve(twin int) (TwinClient, error) {
+	entry, err := r.get(twin)
+	if err != nil {
+		return nil, err
+	}
+
+	r.m.RLock()
+	transport := r.transport
+	r.m.RUnlock()
+	return newTwinClient(transport, twin, entry.addresses...)
+}
+
+func (r *StaticResolver) setTransport(transport *peerTransport) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.transport = transport
+}
+
+func (r *StaticResolver) PublicKey(twin int) ([]byte, error) {
+	entry, err := r.get(twin)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.publicKey, nil
+}
+
+// KeyType returns the key type of the twin
+func (r *StaticResolver) KeyType(twin int) (string, error) {
+	entry, err := r.get(twin)
+	if err != nil {
+		return "", err
+	}
+
+	return entry.keyType, nil
+}
+
+// TwinID finds the twin that owns the public key
+func (r *StaticResolver) TwinID(publicKey []byte) (int, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	for id, entry := range r.twins {
+		if string(entry.publicKey) == string(publicKey) {
+			return id, nil
+		}
+	}
+	return 0, errors.Wrap(substrate.ErrNotFound, "public key is not in the twins file")
+}
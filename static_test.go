@@ -0,0 +1,150 @@
+package rmb
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/substrate-client"
+)
+
+func TestStaticResolver(t *testing.T) {
+	identity, err := substrate.NewIdentityFromEd25519Key(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	require.NoError(t, err)
+	sr, err := substrate.NewIdentityFromSr25519Phrase(testMnemonics)
+	require.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "twins.yaml")
+	writeFile(t, file, fmt.Sprintf(`
+twins:
+  - id: 1
+    address: 10.10.0.1
+    public_key: 0x%s
+    key_type: ed25519
+  - id: 2
+    address: 10.10.0.2
+    public_key: %s
+    key_type: sr25519
+`, hex.EncodeToString(identity.PublicKey()), sr.Address()))
+
+	resolver, err := NewStaticResolver(file)
+	require.NoError(t, err)
+
+	client, err := resolver.Resolve(1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://10.10.0.1:8051"}, client.(*twinClient).endpoints)
+
+	pk, err := resolver.PublicKey(2)
+	require.NoError(t, err)
+	assert.Equal(t, sr.PublicKey(), pk)
+
+	keyType, err := resolver.KeyType(2)
+	require.NoError(t, err)
+	assert.Equal(t, SignatureTypeSr25519, keyType)
+
+	id, err := resolver.TwinID(identity.PublicKey())
+	require.NoError(t, err)
+	assert.Equal(t, 1, id)
+
+	_, err = resolver.Resolve(3)
+	assert.True(t, errors.Is(err, substrate.ErrNotFound))
+
+	// json works too, and invalid files keep the loaded twins
+	writeFile(t, file, fmt.Sprintf(`{"twins": [{"id": 3, "address": "10.10.0.3", "public_key": "%s", "key_type": "ed25519"}]}`,
+		hex.EncodeToString(identity.PublicKey())))
+	require.NoError(t, resolver.Reload())
+	_, err = resolver.Resolve(1)
+	assert.True(t, errors.Is(err, substrate.ErrNotFound))
+	_, err = resolver.Resolve(3)
+	assert.NoError(t, err)
+
+	writeFile(t, file, `{"twins": [{"id": 4, "address": "10.10.0.4", "public_key": "00", "key_type": "ed25519"}]}`)
+	assert.Error(t, resolver.Reload())
+	_, err = resolver.Resolve(3)
+	assert.NoError(t, err)
+}
+
+func TestStaticResolverInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "twins.yaml")
+	key := hex.EncodeToString(make([]byte, 32))
+
+	cases := []string{
+		fmt.Sprintf(`{"twins": [{"id": 1, "public_key": "%s", "key_type": "ed25519"}]}`, key),
+		fmt.Sprintf(`{"twins": [{"id": 1, "address": "10.0.0.1", "public_key": "%s", "key_type": "rsa"}]}`, key),
+		`{"twins": [{"id": 1, "address": "10.0.0.1", "public_key": "not a key", "key_type": "ed25519"}]}`,
+		fmt.Sprintf(`{"twins": [{"id": 1, "address": "10.0.0.1", "public_key": "%s", "key_type": "ed25519"},
+			{"id": 1, "address": "10.0.0.2", "public_key": "%s", "key_type": "ed25519"}]}`, key, key),
+		`{"twins": [{"id": 1, "addr": "10.0.0.1"}]}`,
+	}
+	for _, content := range cases {
+		writeFile(t, file, content)
+		_, err := NewStaticResolver(file)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestNewServerStaticResolver(t *testing.T) {
+	identity, err := substrate.NewIdentityFromEd25519Key(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	require.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "twins.json")
+	writeFile(t, file, fmt.Sprintf(`{"twins": [{"id": 5, "address": "10.10.0.5", "public_key": "%s", "key_type": "ed25519"}]}`,
+		hex.EncodeToString(identity.PublicKey())))
+	resolver, err := NewStaticResolver(file)
+	require.NoError(t, err)
+
+	// no chain is needed to find the server twin
+	app, err := NewServer(nil, "", 1, identity, WithResolver(resolver))
+	require.NoError(t, err)
+	assert.Equal(t, 5, app.twin)
+}
+
+func TestStaticResolverKeyType(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	app, _, _ := setup(ctrl)
+
+	// both twins have the key of the app identity, the second one is declared
+	// as an sr25519 key
+	file := filepath.Join(t.TempDir(), "twins.yaml")
+	writeFile(t, file, fmt.Sprintf(`
+twins:
+  - id: 2
+    address: 10.10.0.2
+    public_key: 0x%[1]s
+    key_type: ed25519
+  - id: 3
+    address: 10.10.0.3
+    public_key: 0x%[1]s
+    key_type: sr25519
+`, hex.EncodeToString(app.identity.PublicKey())))
+	static, err := NewStaticResolver(file)
+	require.NoError(t, err)
+	app.resolver = NewChainedResolver(NewCacheResolver(static, time.Minute))
+
+	for twin, valid := range map[int]bool{2: true, 3: false} {
+		msg := Message{
+			Version:  ProtocolV2,
+			ID:       fmt.Sprintf("%d.1", twin),
+			Command:  "griddb.twins.get",
+			TwinSrc:  twin,
+			TwinDst:  []int{1},
+			Retqueue: "msgbus.system.reply",
+			Epoch:    time.Now().Unix(),
+		}
+		require.NoError(t, msg.Sign(app.identity))
+		_, err := app.authenticate(context.Background(), &msg)
+		if valid {
+			assert.NoError(t, err)
+		} else {
+			assert.ErrorContains(t, err, "doesn't match the sr25519 key")
+		}
+	}
+}
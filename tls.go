@@ -0,0 +1,329 @@
+package rmb
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/substrate-client"
+)
+
+// The TLS certificates of the peers use an ephemeral key, bound to the twin by
+// a certificate extension holding the twin id and the signature of the
+// certificate public key by the twin identity key. A peer checks the signature
+// against the twin public key (from the chain or the static resolver), so the
+// certificate can only be presented by the twin.
+const (
+	tlsBindingDomain = "rmb.tls.v1"
+
+	tlsCertificateValidity = 365 * 24 * time.Hour
+)
+
+// handshakeLimit limits the peer certificates verified for each remote address,
+// each one can cost a public key lookup of the twin the peer claims. The
+// connections are pooled and resumed, so the peers don't do many handshakes.
+var handshakeLimit = RateLimit{Rate: 1, Burst: 20}
+
+var (
+	// oidTwinBinding identifies the twin binding certificate extension
+	oidTwinBinding = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57367, 1, 1}
+
+	// ErrPeerNotVerified is returned if the peer TLS certificate doesn't prove its twin
+	ErrPeerNotVerified = fmt.Errorf("peer twin is not verified")
+)
+
+type twinBinding struct {
+	Twin      int
+	KeyType   string
+	Signature []byte
+}
+
+// bindingPayload is what the twin signs to bind a certificate public key
+func bindingPayload(twin int, publicKeyInfo []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(tlsBindingDomain)
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], uint64(twin))
+	buf.Write(id[:])
+	buf.Write(publicKeyInfo)
+	return buf.Bytes()
+}
+
+// newTwinCertificate creates a self signed certificate for a new ephemeral key,
+// bound to the twin identity
+func newTwinCertificate(identity substrate.Identity, twin int) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	publicKeyInfo, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	signature, err := identity.Sign(bindingPayload(twin, publicKeyInfo))
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "couldn't sign certificate key")
+	}
+	binding, err := asn1.Marshal(twinBinding{Twin: twin, KeyType: identity.Type(), Signature: signature})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("twin-%d", twin)},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(tlsCertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidTwinBinding, Value: binding},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "couldn't create certificate")
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// certificateBinding returns the twin binding of the certificate, ok is false
+// if the certificate doesn't have one
+func certificateBinding(cert *x509.Certificate) (binding twinBinding, ok bool, err error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidTwinBinding) {
+			continue
+		}
+		rest, err := asn1.Unmarshal(ext.Value, &binding)
+		if err != nil || len(rest) != 0 {
+			return binding, true, errors.Wrap(ErrPeerNotVerified, "invalid twin binding")
+		}
+		return binding, true, nil
+	}
+	return binding, false, nil
+}
+
+// verifyTwinCertificate checks that the certificate is bound to its twin and
+// returns the twin
+func verifyTwinCertificate(cert *x509.Certificate, twinKey twinKeyFunc) (int, error) {
+	binding, ok, err := certificateBinding(cert)
+	if err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, errors.Wrap(ErrPeerNotVerified, "certificate is not bound to a twin")
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return 0, errors.Wrap(ErrPeerNotVerified, "certificate is expired or not valid yet")
+	}
+
+	pk, keyType, err := twinKey(binding.Twin)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't get twin %d public key", binding.Twin)
+	}
+	verifier, err := constructVerifier(pk, binding.KeyType, keyType)
+	if err != nil {
+		return 0, errors.Wrap(ErrPeerNotVerified, err.Error())
+	}
+	if !verifier.Verify(bindingPayload(binding.Twin, cert.RawSubjectPublicKeyInfo), binding.Signature) {
+		return 0, errors.Wrapf(ErrPeerNotVerified, "certificate is not signed by twin %d", binding.Twin)
+	}
+
+	return binding.Twin, nil
+}
+
+// handshakeLimiter applies handshakeLimit to each remote address
+type handshakeLimiter struct {
+	m       sync.Mutex
+	buckets *cache.Cache
+}
+
+func newHandshakeLimiter() *handshakeLimiter {
+	return &handshakeLimiter{buckets: cache.New(rateLimitIdle, time.Minute)}
+}
+
+// allow checks if a certificate of a peer at the remote host can be verified
+func (l *handshakeLimiter) allow(host string) bool {
+	if l == nil {
+		return true
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	var b *bucket
+	if cached, ok := l.buckets.Get(host); ok {
+		b = cached.(*bucket)
+	} else {
+		b = &bucket{}
+	}
+	l.buckets.Set(host, b, cache.DefaultExpiration)
+	if wait := b.refill(handshakeLimit, time.Now()); wait > 0 {
+		b.limited++
+		return false
+	}
+	b.take(handshakeLimit)
+	return true
+}
+
+// verifyPeerCertificate verifies the twin certificate a peer presented, if any
+func (a *App) verifyPeerCertificate(host string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return nil
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if !a.handshakes.allow(host) {
+			return errors.Wrapf(ErrPeerNotVerified, "too many handshakes from %s", host)
+		}
+		_, err = verifyTwinCertificate(cert, a.twinKey)
+		return err
+	}
+}
+
+// serverTLSConfig is the TLS configuration of the server, the peers are asked
+// for their certificate which is verified if given. The verifications are
+// limited for each remote address (see handshakeLimit).
+func (a *App) serverTLSConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{a.certificate},
+		ClientAuth:   tls.RequestClientCert,
+		// set here since the http server only adds http/1.1 to its own copy
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		var host string
+		if hello.Conn != nil {
+			host, _, _ = net.SplitHostPort(hello.Conn.RemoteAddr().String())
+		}
+		peer := cfg.Clone()
+		peer.GetConfigForClient = nil
+		peer.VerifyPeerCertificate = a.verifyPeerCertificate(host)
+		return peer, nil
+	}
+	return cfg
+}
+
+// checkPeer checks that a message received over TLS (or QUIC) comes from the
+// twin of the peer certificate (already verified during the handshake), or that
+// a message received over a peer link comes from the twin of the link
+func (a *App) checkPeer(r *http.Request, msg *Message) error {
+	// the twin of a link proved its identity when the link was opened
+	if link, ok := r.Context().Value(linkPeer{}).(*peerLink); ok {
+		// the relay delivers the messages of all the twins
+		if !link.relay && link.twin != msg.TwinSrc {
+			return errors.Wrapf(ErrPeerNotVerified, "message from twin %d sent over the link of twin %d", msg.TwinSrc, link.twin)
+		}
+		return nil
+	}
+	if twin, ok := r.Context().Value(quicPeer{}).(int); ok {
+		if twin != msg.TwinSrc {
+			return errors.Wrapf(ErrPeerNotVerified, "message from twin %d sent by twin %d", msg.TwinSrc, twin)
+		}
+		return nil
+	}
+	// the envelopes of the grid relay are signed by their twin
+	if isEnvelopeDelivery(r.Context()) {
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		if a.serveTLS && a.requirePeer {
+			return errors.Wrap(ErrPeerNotVerified, "a twin certificate is required")
+		}
+		return nil
+	}
+
+	binding, ok, err := certificateBinding(r.TLS.PeerCertificates[0])
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.Wrap(ErrPeerNotVerified, "certificate is not bound to a twin")
+	}
+	if binding.Twin != msg.TwinSrc {
+		return errors.Wrapf(ErrPeerNotVerified, "message from twin %d sent by twin %d", msg.TwinSrc, binding.Twin)
+	}
+	return nil
+}
+
+// twinKeyFunc returns the public key of a twin, and its key type if it's known
+type twinKeyFunc func(twin int) (publicKey []byte, keyType string, err error)
+
+// twinKey gets a twin public key from the current resolver, with its key type
+// if the resolver knows it
+func (a *App) twinKey(twin int) ([]byte, string, error) {
+	pk, err := a.resolver.PublicKey(twin)
+	if err != nil {
+		return nil, "", err
+	}
+	var keyType string
+	if typed, ok := a.resolver.(keyTypeResolver); ok {
+		if keyType, err = typed.KeyType(twin); err != nil {
+			return nil, "", errors.Wrapf(err, "couldn't get twin %d key type", twin)
+		}
+	}
+	return pk, keyType, nil
+}
+
+// clientTLSConfig is the TLS configuration used to connect to twin. The twin
+// certificate must be bound to the twin. If publicCA is set, peers behind a
+// reverse proxy with a certificate from a public CA are accepted as long as the
+// certificate is valid for the host name.
+func clientTLSConfig(twin int, cert *tls.Certificate, twinKey twinKeyFunc, publicCA bool) *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*cert},
+		// the usual chain verification is replaced by VerifyConnection
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.Wrap(ErrPeerNotVerified, "peer has no certificate")
+			}
+			leaf := state.PeerCertificates[0]
+			if _, ok, _ := certificateBinding(leaf); !ok && publicCA {
+				intermediates := x509.NewCertPool()
+				for _, cert := range state.PeerCertificates[1:] {
+					intermediates.AddCert(cert)
+				}
+				_, err := leaf.Verify(x509.VerifyOptions{DNSName: state.ServerName, Intermediates: intermediates})
+				return err
+			}
+
+			peer, err := verifyTwinCertificate(leaf, twinKey)
+			if err != nil {
+				return err
+			}
+			if peer != twin {
+				return errors.Wrapf(ErrPeerNotVerified, "expected twin %d but the peer is twin %d", twin, peer)
+			}
+			return nil
+		},
+	}
+}
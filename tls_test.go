@@ -0,0 +1,155 @@
+package rmb
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/substrate-client"
+)
+
+// testKeys resolves the public keys of the twins only
+type testKeys map[int][]byte
+
+func (k testKeys) Resolve(twin int) (TwinClient, error) {
+	return nil, errors.Wrapf(substrate.ErrNotFound, "twin %d", twin)
+}
+
+func (k testKeys) PublicKey(twin int) ([]byte, error) {
+	pk, ok := k[twin]
+	if !ok {
+		return nil, errors.Wrapf(substrate.ErrNotFound, "twin %d", twin)
+	}
+	return pk, nil
+}
+
+// twinKey returns the key of the twin, the key type is not known
+func (k testKeys) twinKey(twin int) ([]byte, string, error) {
+	pk, err := k.PublicKey(twin)
+	return pk, "", err
+}
+
+func testIdentities(t *testing.T) (substrate.Identity, substrate.Identity, testKeys) {
+	ed, err := substrate.NewIdentityFromEd25519Key(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	require.NoError(t, err)
+	sr, err := substrate.NewIdentityFromSr25519Phrase(testMnemonics)
+	require.NoError(t, err)
+	return ed, sr, testKeys{1: ed.PublicKey(), 2: sr.PublicKey()}
+}
+
+func TestTwinCertificate(t *testing.T) {
+	ed, sr, keys := testIdentities(t)
+
+	for twin, identity := range map[int]substrate.Identity{1: ed, 2: sr} {
+		cert, err := newTwinCertificate(identity, twin)
+		require.NoError(t, err)
+
+		peer, err := verifyTwinCertificate(cert.Leaf, keys.twinKey)
+		require.NoError(t, err)
+		assert.Equal(t, twin, peer)
+	}
+
+	// a certificate signed with another key than the twin one
+	cert, err := newTwinCertificate(sr, 1)
+	require.NoError(t, err)
+	_, err = verifyTwinCertificate(cert.Leaf, keys.twinKey)
+	assert.True(t, errors.Is(err, ErrPeerNotVerified))
+}
+
+func TestMutualTLS(t *testing.T) {
+	ed, sr, keys := testIdentities(t)
+
+	serverCert, err := newTwinCertificate(ed, 1)
+	require.NoError(t, err)
+	app := App{
+		resolver:    keys,
+		certificate: serverCert,
+		serveTLS:    true,
+		requirePeer: true,
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		if err := app.checkPeer(r, &msg); err != nil {
+			errorReply(w, http.StatusForbidden, "%s", err.Error())
+			return
+		}
+		successReply(w)
+	}))
+	server.TLS = app.serverTLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	clientCert, err := newTwinCertificate(sr, 2)
+	require.NoError(t, err)
+	transport := testTransport(DefaultTransportConfig())
+	transport.setIdentity(&clientCert, keys.twinKey)
+
+	client, err := newTwinClient(transport, 1, server.URL)
+	require.NoError(t, err)
+	assert.NoError(t, client.SendRemote(Message{TwinSrc: 2}))
+
+	// the message must come from the twin of the certificate
+	err = client.SendRemote(Message{TwinSrc: 3})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "403")
+
+	// the server must be the expected twin
+	wrong, err := newTwinClient(transport, 2, server.URL)
+	require.NoError(t, err)
+	assert.Error(t, wrong.SendRemote(Message{TwinSrc: 2}))
+
+	// peers without a certificate are refused
+	insecure := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := insecure.Post(server.URL, "application/json", strings.NewReader(`{"src": 2}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestPeerCertificateNotBound(t *testing.T) {
+	ed, _, keys := testIdentities(t)
+
+	// a peer with a certificate that is not bound to its twin
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		successReply(w)
+	}))
+	defer server.Close()
+
+	cert, err := newTwinCertificate(ed, 1)
+	require.NoError(t, err)
+	transport := testTransport(DefaultTransportConfig())
+	transport.setIdentity(&cert, keys.twinKey)
+	client, err := newTwinClient(transport, 2, server.URL)
+	require.NoError(t, err)
+	err = client.SendRemote(Message{TwinSrc: 1})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not bound to a twin")
+
+	// with public CAs accepted, the certificate is verified like any web server
+	cfg := DefaultTransportConfig()
+	cfg.PublicCA = true
+	transport = testTransport(cfg)
+	transport.setIdentity(&cert, keys.twinKey)
+	client, err = newTwinClient(transport, 2, server.URL)
+	require.NoError(t, err)
+	err = client.SendRemote(Message{TwinSrc: 1})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "certificate signed by unknown authority")
+}
+
+func TestHandshakeLimiter(t *testing.T) {
+	limiter := newHandshakeLimiter()
+	for i := 0; i < handshakeLimit.Burst; i++ {
+		assert.True(t, limiter.allow("10.0.0.1"))
+	}
+	assert.False(t, limiter.allow("10.0.0.1"))
+	assert.True(t, limiter.allow("10.0.0.2"))
+}
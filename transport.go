@@ -0,0 +1,203 @@
+package rmb
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// TransportConfig configures the http transport shared by all the twin clients
+type TransportConfig struct {
+	// DialTimeout limits the time to open a connection to a peer
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout limits the time of the TLS handshake with a peer
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout limits the time to wait for the peer response once
+	// the request is sent
+	ResponseHeaderTimeout time.Duration
+	// RequestTimeout limits the whole request, including the connection
+	RequestTimeout time.Duration
+	// IdleConnTimeout is how long an idle keep-alive connection is kept open
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerPeer is the maximum number of idle connections kept open
+	// to each peer
+	MaxIdleConnsPerPeer int
+	// MaxConnsPerPeer is the maximum number of connections (active and idle)
+	// to each peer, zero means no limit
+	MaxConnsPerPeer int
+	// HTTP2 enables HTTP/2 with the peers that support it (over TLS)
+	HTTP2 bool
+	// PublicCA accepts the https peers presenting a certificate from a public
+	// CA valid for their host name instead of a certificate bound to their
+	// twin, e.g. twins behind a reverse proxy. The certificates bound to a twin
+	// are always verified against it.
+	PublicCA bool
+	// Proxy routes the connections to the peers through a proxy
+	Proxy ProxyConfig
+}
+
+// DefaultTransportConfig returns the default peer transport configuration
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		DialTimeout:           5 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		RequestTimeout:        10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerPeer:   4,
+		MaxConnsPerPeer:       16,
+		HTTP2:                 true,
+	}
+}
+
+// Valid validates the transport configuration
+func (c *TransportConfig) Valid() error {
+	if c.DialTimeout <= 0 || c.TLSHandshakeTimeout <= 0 || c.ResponseHeaderTimeout <= 0 || c.RequestTimeout <= 0 {
+		return fmt.Errorf("transport timeouts must be positive")
+	}
+	if c.MaxIdleConnsPerPeer < 0 || c.MaxConnsPerPeer < 0 {
+		return fmt.Errorf("transport connections limits can't be negative")
+	}
+	return c.Proxy.Valid()
+}
+
+// peerTransport holds the pooled connections to the peers
+type peerTransport struct {
+	client  *http.Client
+	base    *http.Transport
+	dialer  contextDialer
+	timeout time.Duration
+	// preferred remembers the endpoint of each twin that answered last, it's
+	// kept outside of the clients so it survives the resolvers cache
+	preferred *cache.Cache
+
+	// twin identity used for mutual TLS, the https peers get their own pool
+	// so each connection is verified against its twin
+	certificate *tls.Certificate
+	twinKey     twinKeyFunc
+	publicCA    bool
+	m           sync.Mutex
+	tlsClients  *cache.Cache
+
+	// registry maps the twin address schemes to their transport
+	registry transportRegistry
+}
+
+var (
+	defaultTransport     *peerTransport
+	defaultTransportOnce sync.Once
+)
+
+// sharedDefaultTransport is used by the twin clients created without a transport
+func sharedDefaultTransport() *peerTransport {
+	defaultTransportOnce.Do(func() {
+		// the default configuration has no proxy, it can't fail
+		defaultTransport, _ = newPeerTransport(DefaultTransportConfig())
+	})
+	return defaultTransport
+}
+
+func newPeerTransport(cfg TransportConfig) (*peerTransport, error) {
+	var dialer contextDialer = &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy.URL != "" {
+		// the proxy is used to dial so it also applies to the endpoints race
+		// and the TLS peers
+		proxied, err := newProxyDialer(dialer, cfg.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		dialer, proxy = proxied, nil
+	}
+
+	peers := &peerTransport{
+		dialer:    dialer,
+		timeout:   cfg.RequestTimeout,
+		preferred: cache.New(time.Hour, 10*time.Minute),
+		publicCA:  cfg.PublicCA,
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           peers.dialContext,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerPeer,
+		MaxConnsPerHost:       cfg.MaxConnsPerPeer,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+	}
+
+	tlsClients := cache.New(time.Hour, 10*time.Minute)
+	tlsClients.OnEvicted(func(_ string, client interface{}) {
+		client.(*http.Client).CloseIdleConnections()
+	})
+
+	peers.client = &http.Client{Transport: transport}
+	peers.base = transport
+	peers.tlsClients = tlsClients
+	peers.registry.register(httpTransport{peers}, "http", "https")
+	peers.registry.register(newUnixTransport(peers), "unix")
+	peers.registry.register(relayTransport{peers}, "relay", "relays")
+	peers.registry.register(newQUICTransport(peers, cfg), "quic")
+	return peers, nil
+}
+
+// dialContext dials the peers, with the connection that won the endpoints race
+// if the request has one
+func (t *peerTransport) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if race, ok := ctx.Value(racedConn{}).(*raced); ok {
+		if conn := race.take(address); conn != nil {
+			return conn, nil
+		}
+	}
+	if timeout, ok := ctx.Value(dialTimeout{}).(time.Duration); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return t.dialer.DialContext(ctx, network, address)
+}
+
+// setIdentity enables mutual TLS with the https peers, the certificate is
+// presented to the peers and their certificates are verified with twinKey
+func (t *peerTransport) setIdentity(certificate *tls.Certificate, twinKey twinKeyFunc) {
+	t.certificate = certificate
+	t.twinKey = twinKey
+}
+
+// clientFor returns the http client used to send to the twin endpoint
+func (t *peerTransport) clientFor(twin int, endpoint string) *http.Client {
+	if t.certificate == nil || !strings.HasPrefix(endpoint, "https://") {
+		return t.client
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	key := fmt.Sprint(twin)
+	if client, ok := t.tlsClients.Get(key); ok {
+		return client.(*http.Client)
+	}
+
+	transport := t.base.Clone()
+	transport.TLSClientConfig = clientTLSConfig(twin, t.certificate, t.twinKey, t.publicCA)
+	client := &http.Client{Transport: transport}
+	t.tlsClients.Set(key, client, cache.DefaultExpiration)
+	return client
+}
+
+// transportSetter is implemented by the resolvers creating twin clients, so the
+// clients use the server transport
+type transportSetter interface {
+	setTransport(transport *peerTransport)
+}
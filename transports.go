@@ -0,0 +1,238 @@
+package rmb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TwinTransport creates the clients used to send messages to the twins. Each
+// transport is registered for one or more address schemes, and gets the twin
+// addresses with these schemes (in order of preference) when a twin is resolved.
+type TwinTransport interface {
+	NewClient(twin int, endpoints []string) (TwinClient, error)
+}
+
+// TwinTransportFunc is a function implementing TwinTransport
+type TwinTransportFunc func(twin int, endpoints []string) (TwinClient, error)
+
+// NewClient implements TwinTransport
+func (f TwinTransportFunc) NewClient(twin int, endpoints []string) (TwinClient, error) {
+	return f(twin, endpoints)
+}
+
+// registration is a registered transport, the endpoints of all the schemes it
+// was registered for are given to the same client
+type registration struct {
+	transport TwinTransport
+}
+
+// schemeTransport is a transport registered with WithTwinTransport
+type schemeTransport struct {
+	transport TwinTransport
+	schemes   []string
+}
+
+// transportRegistry maps the address schemes to their transports
+type transportRegistry struct {
+	m       sync.RWMutex
+	schemes map[string]*registration
+}
+
+// register sets the transport used for the schemes, replacing the transport
+// previously registered for them
+func (r *transportRegistry) register(transport TwinTransport, schemes ...string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.schemes == nil {
+		r.schemes = make(map[string]*registration)
+	}
+	entry := &registration{transport: transport}
+	for _, scheme := range schemes {
+		r.schemes[strings.ToLower(scheme)] = entry
+	}
+}
+
+// newClient creates the client of the twin endpoints. The endpoints are given to
+// the transport of their scheme, if the twin has endpoints with different
+// transports they are tried in order.
+func (r *transportRegistry) newClient(twin int, endpoints []string) (TwinClient, error) {
+	r.m.RLock()
+	var order []*registration
+	groups := make(map[*registration][]string)
+	for _, endpoint := range endpoints {
+		scheme := endpointScheme(endpoint)
+		entry, ok := r.schemes[scheme]
+		if !ok {
+			r.m.RUnlock()
+			return nil, fmt.Errorf("unsupported scheme '%s' in twin address '%s'", scheme, endpoint)
+		}
+		if _, ok := groups[entry]; !ok {
+			order = append(order, entry)
+		}
+		groups[entry] = append(groups[entry], endpoint)
+	}
+	r.m.RUnlock()
+
+	clients := make([]TwinClient, 0, len(order))
+	for _, entry := range order {
+		client, err := entry.transport.NewClient(twin, groups[entry])
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't create client of twin %d", twin)
+		}
+		clients = append(clients, client)
+	}
+	if len(clients) == 1 {
+		return clients[0], nil
+	}
+	return fallbackClient(clients), nil
+}
+
+func endpointScheme(endpoint string) string {
+	if i := strings.Index(endpoint, "://"); i > 0 {
+		return strings.ToLower(endpoint[:i])
+	}
+	return ""
+}
+
+// fallbackClient tries the clients of a twin in order, the next client is only
+// tried if the twin couldn't be reached with the previous one
+type fallbackClient []TwinClient
+
+func (c fallbackClient) send(fn func(client TwinClient) error) error {
+	var err error
+	for _, client := range c {
+		if err = fn(client); err == nil || !errors.Is(err, ErrTwinUnreachable) {
+			return err
+		}
+	}
+	return err
+}
+
+func (c fallbackClient) SendRemote(msg Message) error {
+	return c.send(func(client TwinClient) error { return client.SendRemote(msg) })
+}
+
+func (c fallbackClient) SendReply(msg Message) error {
+	return c.send(func(client TwinClient) error { return client.SendReply(msg) })
+}
+
+// httpTransport sends the messages to the http and https endpoints with the
+// pooled peer transport
+type httpTransport struct {
+	peers *peerTransport
+}
+
+func (t httpTransport) NewClient(twin int, endpoints []string) (TwinClient, error) {
+	return &twinClient{twin: twin, endpoints: endpoints, transport: t.peers}, nil
+}
+
+// connClient posts the messages over http on the connections it dials itself,
+// for the transports that don't use tcp
+type connClient struct {
+	twin    int
+	base    string
+	client  *http.Client
+	timeout time.Duration
+}
+
+func (c *connClient) send(url func(base string) string, msg Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	var buffer bytes.Buffer
+	if err := json.NewEncoder(&buffer).Encode(msg); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url(c.base), &buffer)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return unreachableError{errors.Wrapf(err, "twin %d is not reachable", c.twin)}
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to send remote: %s (%s)", resp.Status, readError(resp.Body))
+	}
+
+	return nil
+}
+
+func (c *connClient) SendRemote(msg Message) error {
+	return c.send(remoteURL, msg)
+}
+
+func (c *connClient) SendReply(msg Message) error {
+	return c.send(replyURL, msg)
+}
+
+// unixTransport sends the messages to rmb servers listening on a unix socket,
+// with addresses like `unix:///run/rmb.sock`
+type unixTransport struct {
+	peers *peerTransport
+
+	m       sync.Mutex
+	clients map[string]*http.Client
+}
+
+func newUnixTransport(peers *peerTransport) *unixTransport {
+	return &unixTransport{peers: peers, clients: make(map[string]*http.Client)}
+}
+
+// clientFor returns the http client connecting to the socket
+func (t *unixTransport) clientFor(socket string) *http.Client {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if client, ok := t.clients[socket]; ok {
+		return client
+	}
+	transport := t.peers.base.Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return t.peers.dialer.DialContext(ctx, "unix", socket)
+	}
+	client := &http.Client{Transport: transport}
+	t.clients[socket] = client
+	return client
+}
+
+func (t *unixTransport) NewClient(twin int, endpoints []string) (TwinClient, error) {
+	var clients fallbackClient
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host != "" || u.Path == "" {
+			return nil, fmt.Errorf("invalid unix socket address '%s', expected unix:///path/to/socket", endpoint)
+		}
+		clients = append(clients, &connClient{
+			twin:    twin,
+			base:    "http://unix",
+			client:  t.clientFor(u.Path),
+			timeout: t.peers.timeout,
+		})
+	}
+	if len(clients) == 1 {
+		return clients[0], nil
+	}
+	return clients, nil
+}
@@ -0,0 +1,107 @@
+package rmb
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTransport creates a peer transport, the tests configurations are valid
+func testTransport(cfg TransportConfig) *peerTransport {
+	transport, err := newPeerTransport(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return transport
+}
+
+// serveMessages serves the rmb endpoints on l and sends the received messages
+// to the returned channel
+func serveMessages(t *testing.T, l net.Listener) <-chan Message {
+	received := make(chan Message, 10)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- msg
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/zbus-remote", handler)
+	mux.HandleFunc("/zbus-reply", handler)
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return received
+}
+
+func TestInProcessTransport(t *testing.T) {
+	inproc := NewInProcessTransport()
+	transport := testTransport(DefaultTransportConfig())
+	transport.registry.register(inproc, "inproc")
+
+	l, err := inproc.Listen("twin-2")
+	require.NoError(t, err)
+	received := serveMessages(t, l)
+
+	_, err = inproc.Listen("twin-2")
+	assert.Error(t, err)
+
+	// the first address is not listening, the twin is reached on the second one
+	client, err := newTwinClient(transport, 2, "inproc://twin-3,inproc://twin-2")
+	require.NoError(t, err)
+	require.NoError(t, client.SendRemote(Message{ID: "1", TwinDst: []int{2}}))
+	assert.Equal(t, "1", (<-received).ID)
+	require.NoError(t, client.SendReply(Message{ID: "2"}))
+	assert.Equal(t, "2", (<-received).ID)
+
+	down, err := newTwinClient(transport, 3, "inproc://twin-3")
+	require.NoError(t, err)
+	err = down.SendRemote(Message{ID: "3"})
+	assert.True(t, errors.Is(err, ErrTwinUnreachable))
+}
+
+func TestUnixTransport(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "rmb.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	received := serveMessages(t, l)
+
+	client, err := newTwinClient(testTransport(DefaultTransportConfig()), 2, "unix://"+socket)
+	require.NoError(t, err)
+	require.NoError(t, client.SendRemote(Message{ID: "1"}))
+	assert.Equal(t, "1", (<-received).ID)
+
+	_, err = newTwinClient(nil, 2, "unix://host/rmb.sock")
+	assert.Error(t, err)
+}
+
+func TestTransportSchemes(t *testing.T) {
+	transport := testTransport(DefaultTransportConfig())
+	_, err := newTwinClient(transport, 2, "ftp://node.example.com")
+	assert.Error(t, err)
+
+	// the http and https addresses share one client, the other schemes get
+	// their own and are tried after
+	var endpoints [][]string
+	transport.registry.register(TwinTransportFunc(func(twin int, e []string) (TwinClient, error) {
+		endpoints = append(endpoints, e)
+		return &TwinClientMock{}, nil
+	}), "ws", "wss")
+
+	client, err := newTwinClient(transport, 2, "10.0.0.1,ws://10.0.0.2,https://rmb.example.com,wss://rmb.example.com")
+	require.NoError(t, err)
+	require.IsType(t, fallbackClient{}, client)
+	clients := client.(fallbackClient)
+	require.Len(t, clients, 2)
+	assert.Equal(t, []string{"http://10.0.0.1:8051", "https://rmb.example.com"}, clients[0].(*twinClient).endpoints)
+	assert.Equal(t, [][]string{{"ws://10.0.0.2", "wss://rmb.example.com"}}, endpoints)
+}
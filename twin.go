@@ -7,13 +7,49 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/threefoldtech/substrate-client"
 )
 
+const (
+	// twins that are not found are cached for a short time only, they can be
+	// created at any time
+	negativeCacheExpiration = 30 * time.Second
+	// cached twins can't be invalidated for that long after they are resolved
+	invalidateHoldoff = 5 * time.Second
+	// the key of a twin is looked up again at most that often after invalid
+	// signatures
+	rekeyInterval = time.Minute
+)
+
+var (
+	// ErrTwinUnreachable is returned if none of the twin addresses could be reached
+	ErrTwinUnreachable = fmt.Errorf("twin is unreachable")
+)
+
+// unreachableError marks the errors of the twins that can't be reached, while
+// keeping the original error
+type unreachableError struct {
+	err error
+}
+
+func (e unreachableError) Error() string {
+	return e.err.Error()
+}
+
+func (e unreachableError) Unwrap() error {
+	return e.err
+}
+
+func (e unreachableError) Is(target error) bool {
+	return target == ErrTwinUnreachable
+}
+
 type TwinResolver interface {
 	Resolve(twin int) (TwinClient, error)
 	PublicKey(twin int) ([]byte, error)
@@ -26,64 +62,313 @@ type TwinClient interface {
 
 type cacheResolver struct {
 	TwinResolver
-	cache *cache.Cache
+	cache    *cache.Cache
+	holdoff  time.Duration
+	m        sync.Mutex
+	inflight map[string]*lookup
+	// generations counts the evictions of each twin, the lookups started
+	// before the last eviction are not cached
+	generations map[int]uint64
+}
+
+// cacheEntry is a cached lookup, failed lookups are cached only if the twin
+// is not found
+type cacheEntry struct {
+	value    interface{}
+	err      error
+	resolved time.Time
+}
+
+// lookup is an in-flight lookup, concurrent lookups of the same key wait for
+// its result instead of asking the resolver again
+type lookup struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// chainedResolver asks its resolvers in order, and falls through to the next
+// one only if the twin is not found
+type chainedResolver struct {
+	resolvers []TwinResolver
 }
 
 type substrateResolver struct {
-	client *substrate.Substrate
+	client    *substrate.Substrate
+	transport *peerTransport
 }
 
 type twinClient struct {
-	dstIP string
+	twin int
+	// endpoints are the base urls of the twin rmb, in order of preference
+	endpoints []string
+	transport *peerTransport
+	// relay is set if the endpoints are the relay of the twin, the relay is
+	// not the twin so its certificate is verified like any web server
+	relay bool
+}
+
+// newTwinClient creates a client for the twin addresses, each address can be a
+// comma separated list (see parseTwinAddresses). The client depends on the
+// scheme of the addresses (see TwinTransport). The shared default transport is
+// used if transport is nil.
+func newTwinClient(transport *peerTransport, twin int, addresses ...string) (TwinClient, error) {
+	endpoints, err := parseTwinAddresses(addresses...)
+	if err != nil {
+		return nil, err
+	}
+	if transport == nil {
+		transport = sharedDefaultTransport()
+	}
+	return transport.registry.newClient(twin, endpoints)
 }
 
-func remoteURL(timeIP string) string {
-	return fmt.Sprintf("http://%s:8051/zbus-remote", timeIP)
+func remoteURL(base string) string {
+	return fmt.Sprintf("%s/zbus-remote", base)
 }
 
-func replyURL(timeIP string) string {
-	return fmt.Sprintf("http://%s:8051/zbus-reply", timeIP)
+func replyURL(base string) string {
+	return fmt.Sprintf("%s/zbus-reply", base)
 }
 
+// NewCacheResolver caches the twins found by resolver for expiration. Twins that
+// are not found are cached for a shorter time, and concurrent lookups of the same
+// twin are merged.
 func NewCacheResolver(resolver TwinResolver, expiration time.Duration) TwinResolver {
 	return &cacheResolver{
 		TwinResolver: resolver,
 		cache:        cache.New(expiration, time.Minute),
+		holdoff:      invalidateHoldoff,
+		inflight:     make(map[string]*lookup),
+		generations:  make(map[int]uint64),
 	}
 }
 
+func (c *cacheResolver) get(twin int, key string, fetch func() (interface{}, error)) (interface{}, error) {
+	if cached, ok := c.cache.Get(key); ok {
+		log.Debug().Str("key", key).Msg("cache hit")
+		entry := cached.(cacheEntry)
+		return entry.value, entry.err
+	}
+
+	c.m.Lock()
+	if call, ok := c.inflight[key]; ok {
+		c.m.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &lookup{done: make(chan struct{})}
+	c.inflight[key] = call
+	generation := c.generations[twin]
+	c.m.Unlock()
+
+	call.value, call.err = fetch()
+	entry := cacheEntry{value: call.value, err: call.err, resolved: time.Now()}
+
+	c.m.Lock()
+	// the twin could have been evicted during the lookup, the result is
+	// stale then
+	if c.generations[twin] == generation {
+		if call.err == nil {
+			c.cache.Set(key, entry, cache.DefaultExpiration)
+		} else if errors.Is(call.err, substrate.ErrNotFound) {
+			c.cache.Set(key, entry, negativeCacheExpiration)
+		}
+	}
+	if c.inflight[key] == call {
+		delete(c.inflight, key)
+	}
+	c.m.Unlock()
+	close(call.done)
+
+	return call.value, call.err
+}
+
 func (c *cacheResolver) Resolve(twin int) (TwinClient, error) {
-	key := fmt.Sprint(twin)
-	cached, ok := c.cache.Get(key)
-	if ok {
-		log.Debug().Int("twin", twin).Msg("cache hit")
-		return cached.(TwinClient), nil
+	client, err := c.get(twin, fmt.Sprint(twin), func() (interface{}, error) {
+		return c.TwinResolver.Resolve(twin)
+	})
+	if err != nil {
+		return nil, err
 	}
+	return client.(TwinClient), nil
+}
 
-	client, err := c.TwinResolver.Resolve(twin)
+func (c *cacheResolver) PublicKey(twin int) ([]byte, error) {
+	pk, err := c.get(twin, fmt.Sprintf("pk:%d", twin), func() (interface{}, error) {
+		return c.TwinResolver.PublicKey(twin)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return pk.([]byte), nil
+}
 
-	c.cache.Set(key, client, cache.DefaultExpiration)
-	return client, nil
+func (c *cacheResolver) setTransport(transport *peerTransport) {
+	if setter, ok := c.TwinResolver.(transportSetter); ok {
+		setter.setTransport(transport)
+	}
+	// clients created with the previous transport are dropped
+	c.cache.Flush()
 }
 
-func (c *cacheResolver) PublicKey(twin int) ([]byte, error) {
-	key := fmt.Sprintf("pk:%d", twin)
-	cached, ok := c.cache.Get(key)
-	if ok {
-		log.Debug().Int("twin", twin).Msg("public key cache hit")
-		return cached.([]byte), nil
+// Evict drops the cached twin right away, it's used when the twin changed on
+// the chain
+func (c *cacheResolver) Evict(twin int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.generations[twin]++
+	for _, key := range []string{fmt.Sprint(twin), fmt.Sprintf("pk:%d", twin)} {
+		c.cache.Delete(key)
+		// the lookups in flight are stale, they are not joined anymore
+		delete(c.inflight, key)
 	}
+}
 
-	pk, err := c.TwinResolver.PublicKey(twin)
-	if err != nil {
-		return nil, err
+// Invalidate drops the cached twin after a failure, so it's resolved again on
+// the next attempt. Twins resolved very recently are kept, so failures can't be
+// used to flood the resolver.
+func (c *cacheResolver) Invalidate(twin int) {
+	for _, key := range []string{fmt.Sprint(twin), fmt.Sprintf("pk:%d", twin)} {
+		cached, ok := c.cache.Get(key)
+		if !ok || time.Since(cached.(cacheEntry).resolved) < c.holdoff {
+			continue
+		}
+		log.Debug().Str("key", key).Msg("cache invalidated")
+		c.cache.Delete(key)
+	}
+}
+
+// KeyType returns the key type of the twin if the cached resolver knows it
+func (c *cacheResolver) KeyType(twin int) (string, error) {
+	if typed, ok := c.TwinResolver.(keyTypeResolver); ok {
+		return typed.KeyType(twin)
+	}
+	// the twin must still be known to the resolver
+	_, err := c.PublicKey(twin)
+	return "", err
+}
+
+// TwinID finds the twin that owns the public key, if the cached resolver can
+func (c *cacheResolver) TwinID(publicKey []byte) (int, error) {
+	lookup, ok := c.TwinResolver.(twinIDResolver)
+	if !ok {
+		return 0, fmt.Errorf("resolver can't find twins by public key")
+	}
+	return lookup.TwinID(publicKey)
+}
+
+// NewChainedResolver creates a resolver that asks the given resolvers in order
+// and takes the first answer. The next resolver is only asked if the twin is
+// not found (substrate.ErrNotFound), any other error is returned right away.
+func NewChainedResolver(resolvers ...TwinResolver) TwinResolver {
+	return &chainedResolver{
+		resolvers: resolvers,
 	}
+}
 
-	c.cache.Set(key, pk, cache.DefaultExpiration)
-	return pk, nil
+func (c *chainedResolver) Resolve(twin int) (TwinClient, error) {
+	err := errors.Wrapf(substrate.ErrNotFound, "twin %d", twin)
+	for _, resolver := range c.resolvers {
+		var client TwinClient
+		client, err = resolver.Resolve(twin)
+		if err == nil {
+			return client, nil
+		} else if !errors.Is(err, substrate.ErrNotFound) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (c *chainedResolver) PublicKey(twin int) ([]byte, error) {
+	err := errors.Wrapf(substrate.ErrNotFound, "twin %d", twin)
+	for _, resolver := range c.resolvers {
+		var pk []byte
+		pk, err = resolver.PublicKey(twin)
+		if err == nil {
+			return pk, nil
+		} else if !errors.Is(err, substrate.ErrNotFound) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// KeyType returns the key type known by the resolver that finds the twin, like
+// PublicKey
+func (c *chainedResolver) KeyType(twin int) (string, error) {
+	err := errors.Wrapf(substrate.ErrNotFound, "twin %d", twin)
+	for _, resolver := range c.resolvers {
+		var keyType string
+		if typed, ok := resolver.(keyTypeResolver); ok {
+			keyType, err = typed.KeyType(twin)
+		} else {
+			_, err = resolver.PublicKey(twin)
+		}
+		if err == nil {
+			return keyType, nil
+		} else if !errors.Is(err, substrate.ErrNotFound) {
+			return "", err
+		}
+	}
+	return "", err
+}
+
+// TwinID asks the resolvers that can find twins by public key in order
+func (c *chainedResolver) TwinID(publicKey []byte) (int, error) {
+	err := errors.Wrap(substrate.ErrNotFound, "public key")
+	for _, resolver := range c.resolvers {
+		lookup, ok := resolver.(twinIDResolver)
+		if !ok {
+			continue
+		}
+		var twin int
+		twin, err = lookup.TwinID(publicKey)
+		if err == nil {
+			return twin, nil
+		} else if !errors.Is(err, substrate.ErrNotFound) {
+			return 0, err
+		}
+	}
+	return 0, err
+}
+
+func (c *chainedResolver) setTransport(transport *peerTransport) {
+	for _, resolver := range c.resolvers {
+		if setter, ok := resolver.(transportSetter); ok {
+			setter.setTransport(transport)
+		}
+	}
+}
+
+// Evict evicts the twin from all the resolvers that cache it
+func (c *chainedResolver) Evict(twin int) {
+	for _, resolver := range c.resolvers {
+		if evictor, ok := resolver.(resolverEvictor); ok {
+			evictor.Evict(twin)
+		}
+	}
+}
+
+// Invalidate invalidates the twin in all the resolvers that cache it
+func (c *chainedResolver) Invalidate(twin int) {
+	for _, resolver := range c.resolvers {
+		if invalidator, ok := resolver.(resolverInvalidator); ok {
+			invalidator.Invalidate(twin)
+		}
+	}
+}
+
+// Watch watches all the resolvers that reload their twins
+func (c *chainedResolver) Watch(ctx context.Context, interval time.Duration) {
+	for _, resolver := range c.resolvers {
+		if watcher, ok := resolver.(resolverWatcher); ok {
+			go watcher.Watch(ctx, interval)
+		}
+	}
+	<-ctx.Done()
 }
 
 func NewSubstrateResolver(client *substrate.Substrate) (TwinResolver, error) {
@@ -101,9 +386,7 @@ func (r substrateResolver) Resolve(timeID int) (TwinClient, error) {
 	}
 	log.Debug().Str("ip", twin.IP).Msg("resolved twin ip")
 
-	return &twinClient{
-		dstIP: twin.IP,
-	}, nil
+	return newTwinClient(r.transport, timeID, twin.IP)
 }
 
 func (r substrateResolver) PublicKey(twinID int) ([]byte, error) {
@@ -117,7 +400,20 @@ func (r substrateResolver) PublicKey(twinID int) ([]byte, error) {
 	return twin.Account.PublicKey(), nil
 }
 
-func (c *twinClient) readError(r io.Reader) string {
+func (r *substrateResolver) setTransport(transport *peerTransport) {
+	r.transport = transport
+}
+
+func (r substrateResolver) TwinID(publicKey []byte) (int, error) {
+	twin, err := r.client.GetTwinByPubKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(twin), nil
+}
+
+func readError(r io.Reader) string {
 	var body struct {
 		Status  string `json:"status"`
 		Message string `json:"message"`
@@ -130,51 +426,119 @@ func (c *twinClient) readError(r io.Reader) string {
 	return body.Message
 }
 
-func (c *twinClient) SendRemote(msg Message) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*10))
+// candidates returns the endpoints to try, the one that answered last first if
+// it's known
+func (c *twinClient) candidates() ([]string, bool) {
+	preferred, ok := c.transport.preferred.Get(fmt.Sprint(c.twin))
+	if !ok || !contains(c.endpoints, preferred.(string)) {
+		return append([]string{}, c.endpoints...), false
+	}
+
+	return append([]string{preferred.(string)}, remove(c.endpoints, preferred.(string))...), true
+}
+
+// send posts the message to the twin. If an endpoint can't be reached the other
+// endpoints are tried, so a single unreachable address doesn't cost a retry.
+func (c *twinClient) send(url func(base string) string, msg Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.transport.timeout)
 	defer cancel()
 
 	var buffer bytes.Buffer
 	if err := json.NewEncoder(&buffer).Encode(msg); err != nil {
 		return err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, remoteURL(c.dstIP), &buffer)
-	if err != nil {
-		return err
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+	body := buffer.Bytes()
+
+	candidates, preferred := c.candidates()
+	var lastErr error
+	if preferred && len(candidates) > 1 {
+		// the endpoint that answered last is tried right away, with a short
+		// time to accept the connection so the others still have time left
+		endpoint := candidates[0]
+		postCtx := context.WithValue(ctx, dialTimeout{}, preferredDialTimeout)
+		reached, err := c.post(postCtx, url(endpoint), body)
+		if err == nil || reached {
+			return err
+		}
+
+		log.Debug().Err(err).Int("twin", c.twin).Str("endpoint", endpoint).Msg("preferred twin endpoint is not reachable")
+		c.transport.preferred.Delete(fmt.Sprint(c.twin))
+		lastErr = err
+		candidates = candidates[1:]
 	}
 
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		// body
-		return fmt.Errorf("failed to send remote: %s (%s)", resp.Status, c.readError(resp.Body))
+	for len(candidates) != 0 {
+		// the endpoints race and the connection of the winner is used for the
+		// request
+		endpoint, conn, err := raceEndpoints(ctx, c.transport.dialer, candidates)
+		if err != nil {
+			return unreachableError{errors.Wrapf(err, "twin %d is not reachable", c.twin)}
+		}
+		postCtx := ctx
+		if conn != nil {
+			var race *raced
+			postCtx, race = withRaced(ctx, endpoint, conn)
+			defer race.release()
+		}
+
+		reached, err := c.post(postCtx, url(endpoint), body)
+		if err == nil || reached {
+			if reached {
+				c.transport.preferred.Set(fmt.Sprint(c.twin), endpoint, cache.DefaultExpiration)
+			}
+			return err
+		}
+
+		log.Debug().Err(err).Int("twin", c.twin).Str("endpoint", endpoint).Msg("twin endpoint is not reachable")
+		lastErr = err
+		candidates = remove(candidates, endpoint)
 	}
 
-	return nil
+	return unreachableError{lastErr}
 }
 
-func (c *twinClient) SendReply(msg Message) error {
-	var buffer bytes.Buffer
-	if err := json.NewEncoder(&buffer).Encode(msg); err != nil {
-		return err
+// post sends the body to the url, reached is true if the twin answered even
+// with an error
+func (c *twinClient) post(ctx context.Context, url string, body []byte) (reached bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
 	}
-	resp, err := http.Post(replyURL(c.dstIP), "application/json", &buffer)
+	req.Header.Set("Content-Type", "application/json")
 
+	client := c.transport.client
+	if !c.relay {
+		client = c.transport.clientFor(c.twin, url)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		// body
-		return fmt.Errorf("failed to send remote: %s (%s)", resp.Status, c.readError(resp.Body))
+		return true, fmt.Errorf("failed to send remote: %s (%s)", resp.Status, readError(resp.Body))
+	}
+
+	return true, nil
+}
+
+func remove(items []string, item string) []string {
+	var out []string
+	for _, current := range items {
+		if current != item {
+			out = append(out, current)
+		}
 	}
+	return out
+}
 
-	return err
+func (c *twinClient) SendRemote(msg Message) error {
+	return c.send(remoteURL, msg)
+}
+
+func (c *twinClient) SendReply(msg Message) error {
+	return c.send(replyURL, msg)
 }
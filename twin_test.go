@@ -2,9 +2,16 @@ package rmb
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/threefoldtech/substrate-client"
 )
 
@@ -12,7 +19,7 @@ func TestResolveTwinIP(t *testing.T) {
 	mgr := substrate.NewManager("wss://tfchain.dev.grid.tf/ws")
 	sub, err := mgr.Substrate()
 	if err != nil {
-		t.Errorf("error opening substrate connection: %v", err)
+		t.Skipf("substrate is not reachable: %v", err)
 	}
 	defer sub.Close()
 	resolver, err := NewSubstrateResolver(sub)
@@ -23,8 +30,8 @@ func TestResolveTwinIP(t *testing.T) {
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	if r.(*twinClient).dstIP != "::11" {
-		t.Errorf("expected ::11 found %s", r.(*twinClient).dstIP)
+	if endpoints := r.(*twinClient).endpoints; len(endpoints) != 1 || endpoints[0] != "http://[::11]:8051" {
+		t.Errorf("expected http://[::11]:8051 found %v", endpoints)
 	}
 }
 
@@ -32,7 +39,7 @@ func TestResolveFail(t *testing.T) {
 	mgr := substrate.NewManager("wss://tfchain.dev.grid.tf/ws")
 	sub, err := mgr.Substrate()
 	if err != nil {
-		t.Errorf("error opening substrate connection: %v", err)
+		t.Skipf("substrate is not reachable: %v", err)
 	}
 	defer sub.Close()
 	resolver, err := NewSubstrateResolver(sub)
@@ -48,3 +55,165 @@ func TestResolveFail(t *testing.T) {
 		t.Errorf("r should be nil when the twin is not found")
 	}
 }
+
+func TestChainedResolver(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	override := NewMockTwinResolver(ctrl)
+	fallback := NewMockTwinResolver(ctrl)
+	resolver := NewChainedResolver(override, fallback)
+
+	pinned := &twinClient{endpoints: []string{"http://10.0.0.1:8051"}}
+	override.EXPECT().Resolve(1).Return(pinned, nil)
+	client, err := resolver.Resolve(1)
+	require.NoError(t, err)
+	assert.Equal(t, pinned, client)
+
+	// falls through only if the twin is not found
+	other := &twinClient{endpoints: []string{"http://10.0.0.2:8051"}}
+	override.EXPECT().Resolve(2).Return(nil, errors.Wrap(substrate.ErrNotFound, "twin 2"))
+	fallback.EXPECT().Resolve(2).Return(other, nil)
+	client, err = resolver.Resolve(2)
+	require.NoError(t, err)
+	assert.Equal(t, other, client)
+
+	failure := fmt.Errorf("connection refused")
+	override.EXPECT().PublicKey(3).Return(nil, failure)
+	_, err = resolver.PublicKey(3)
+	assert.Equal(t, failure, err)
+
+	override.EXPECT().PublicKey(4).Return(nil, substrate.ErrNotFound)
+	fallback.EXPECT().PublicKey(4).Return(nil, errors.Wrap(substrate.ErrNotFound, "twin 4"))
+	_, err = resolver.PublicKey(4)
+	assert.True(t, errors.Is(err, substrate.ErrNotFound))
+
+	_, err = NewChainedResolver().Resolve(5)
+	assert.True(t, errors.Is(err, substrate.ErrNotFound))
+}
+
+func TestCacheResolverNegative(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	inner := NewMockTwinResolver(ctrl)
+	resolver := NewCacheResolver(inner, time.Minute)
+
+	// not found is cached
+	inner.EXPECT().Resolve(1).Return(nil, errors.Wrap(substrate.ErrNotFound, "twin 1")).Times(1)
+	for i := 0; i < 3; i++ {
+		_, err := resolver.Resolve(1)
+		assert.True(t, errors.Is(err, substrate.ErrNotFound))
+	}
+
+	// other failures are not
+	inner.EXPECT().PublicKey(2).Return(nil, fmt.Errorf("connection refused")).Times(2)
+	inner.EXPECT().PublicKey(2).Return([]byte("key"), nil).Times(1)
+	for i := 0; i < 2; i++ {
+		_, err := resolver.PublicKey(2)
+		assert.Error(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		pk, err := resolver.PublicKey(2)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("key"), pk)
+	}
+}
+
+func TestCacheResolverCoalescing(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	inner := NewMockTwinResolver(ctrl)
+	resolver := NewCacheResolver(inner, time.Minute)
+
+	var calls int32
+	release := make(chan struct{})
+	client := &twinClient{endpoints: []string{"http://10.0.0.1:8051"}}
+	inner.EXPECT().Resolve(1).DoAndReturn(func(int) (TwinClient, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return client, nil
+	}).AnyTimes()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := resolver.Resolve(1)
+			assert.NoError(t, err)
+			assert.Equal(t, client, got)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestCacheResolverEvictInflight(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	inner := NewMockTwinResolver(ctrl)
+	resolver := NewCacheResolver(inner, time.Minute).(*cacheResolver)
+
+	old := &twinClient{endpoints: []string{"http://10.0.0.1:8051"}}
+	updated := &twinClient{endpoints: []string{"http://10.0.0.2:8051"}}
+	started, release := make(chan struct{}), make(chan struct{})
+	inner.EXPECT().Resolve(1).DoAndReturn(func(int) (TwinClient, error) {
+		close(started)
+		<-release
+		return old, nil
+	}).Times(1)
+	inner.EXPECT().Resolve(1).Return(updated, nil).Times(1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client, err := resolver.Resolve(1)
+		assert.NoError(t, err)
+		assert.Equal(t, old, client)
+	}()
+
+	// the twin changes while it's looked up, the stale result is not cached
+	<-started
+	resolver.Evict(1)
+	close(release)
+	<-done
+
+	client, err := resolver.Resolve(1)
+	require.NoError(t, err)
+	assert.Equal(t, updated, client)
+}
+
+func TestCacheResolverInvalidate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	inner := NewMockTwinResolver(ctrl)
+	resolver := NewCacheResolver(inner, time.Minute).(*cacheResolver)
+
+	old := &twinClient{endpoints: []string{"http://10.0.0.1:8051"}}
+	updated := &twinClient{endpoints: []string{"http://10.0.0.2:8051"}}
+	inner.EXPECT().Resolve(1).Return(old, nil).Times(1)
+	inner.EXPECT().Resolve(1).Return(updated, nil).Times(1)
+
+	client, err := resolver.Resolve(1)
+	require.NoError(t, err)
+	assert.Equal(t, old, client)
+
+	// recently resolved twins are kept
+	resolver.Invalidate(1)
+	client, err = resolver.Resolve(1)
+	require.NoError(t, err)
+	assert.Equal(t, old, client)
+
+	resolver.holdoff = 0
+	NewChainedResolver(resolver).(resolverInvalidator).Invalidate(1)
+	client, err = resolver.Resolve(1)
+	require.NoError(t, err)
+	assert.Equal(t, updated, client)
+}
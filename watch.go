@@ -0,0 +1,42 @@
+package rmb
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// watchFile polls the file modification time every interval and calls
+// reload each time it changes, until the context is canceled.
+func watchFile(ctx context.Context, path string, interval time.Duration, reload func() error) {
+	var last time.Time
+	if stat, err := os.Stat(path); err == nil {
+		last = stat.ModTime()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		stat, err := os.Stat(path)
+		if err != nil {
+			log.Error().Err(err).Str("file", path).Msg("couldn't check watched file")
+			continue
+		}
+		if stat.ModTime().Equal(last) {
+			continue
+		}
+		last = stat.ModTime()
+
+		log.Info().Str("file", path).Msg("file changed, reloading")
+		if err := reload(); err != nil {
+			// keep the last good state
+			log.Error().Err(err).Str("file", path).Msg("couldn't reload file")
+		}
+	}
+}